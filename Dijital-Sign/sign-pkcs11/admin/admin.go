@@ -0,0 +1,178 @@
+// Package admin changes PINs and initialises tokens. Every attempt,
+// successful or not, is recorded in the ledger, including requests rejected
+// before they reach the token; PINs never are.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sign-pkcs11/blockchain"
+	"sign-pkcs11/hsm"
+	"strings"
+	"time"
+)
+
+// ErrInvalidRequest is returned for missing PINs, PINs outside the token's
+// length limits and invalid labels. It is hsm.ErrInvalidRequest, so callers
+// can test for either.
+var ErrInvalidRequest = hsm.ErrInvalidRequest
+
+// ErrConfirmationRequired is returned by InitToken when the confirmation
+// does not match the serial number of the token about to be erased
+var ErrConfirmationRequired = errors.New("ConfirmSerial must match the serial number of the token to initialise")
+
+// Result describes a completed administration operation
+type Result struct {
+	Event    string         `json:"event"`
+	Provider string         `json:"provider"`
+	SlotID   int            `json:"slot_id"`
+	Token    *hsm.TokenInfo `json:"token,omitempty"`
+	Time     string         `json:"time"`
+}
+
+// SetPIN changes the user PIN of a slot. The old PIN must be the one the
+// slot's session pool logged in with.
+func SetPIN(provider string, slotID int, oldPin string, newPin string, bc *blockchain.Blockchain) (*Result, error) {
+	token, err := checkSetPIN(provider, slotID, oldPin, newPin)
+	if err == nil {
+		err = hsm.SetPIN(provider, slotID, oldPin, newPin)
+	}
+	return record("user-pin-change", provider, slotID, token, nil, err, bc)
+}
+
+// checkSetPIN validates a SetPIN request
+func checkSetPIN(provider string, slotID int, oldPin string, newPin string) (*hsm.TokenInfo, error) {
+	if oldPin == "" || newPin == "" {
+		return nil, fmt.Errorf("%w: OldPin and NewPin are required", ErrInvalidRequest)
+	}
+	if oldPin == newPin {
+		return nil, fmt.Errorf("%w: NewPin must differ from OldPin", ErrInvalidRequest)
+	}
+	return checkPIN(provider, slotID, newPin)
+}
+
+// InitPIN sets the user PIN of a slot as security officer, for instance
+// after the user PIN was locked. Sessions borrowed from the slot are closed.
+func InitPIN(provider string, slotID int, soPin string, newPin string, bc *blockchain.Blockchain) (*Result, error) {
+	var token *hsm.TokenInfo
+	err := fmt.Errorf("%w: SoPin and NewPin are required", ErrInvalidRequest)
+	if soPin != "" && newPin != "" {
+		token, err = checkPIN(provider, slotID, newPin)
+	}
+	if err == nil {
+		err = hsm.InitPIN(provider, slotID, soPin, newPin)
+	}
+	return record("user-pin-init", provider, slotID, token, nil, err, bc)
+}
+
+// InitToken erases every object on the token of a slot and gives it a new
+// label. Since this cannot be undone, confirmSerial must repeat the serial
+// number of the token; otherwise ErrConfirmationRequired is returned with
+// the token's information and nothing is changed.
+func InitToken(provider string, slotID int, soPin string, label string, confirmSerial string, bc *blockchain.Blockchain) (*Result, error) {
+	extra := map[string]interface{}{"new_label": label}
+	token, err := checkInitToken(provider, slotID, soPin, label)
+	if err == nil && strings.TrimSpace(confirmSerial) != token.Serial {
+		err = ErrConfirmationRequired
+	}
+	if err == nil {
+		err = hsm.InitToken(provider, slotID, soPin, label)
+	}
+	return record("token-init", provider, slotID, token, extra, err, bc)
+}
+
+// checkInitToken validates an InitToken request and returns the token
+// about to be erased
+func checkInitToken(provider string, slotID int, soPin string, label string) (*hsm.TokenInfo, error) {
+	if soPin == "" {
+		return nil, fmt.Errorf("%w: SoPin is required", ErrInvalidRequest)
+	}
+	if label == "" || len(label) > 32 {
+		return nil, fmt.Errorf("%w: Label must be 1 to 32 bytes long", ErrInvalidRequest)
+	}
+	slot, err := hsm.GetSlot(provider, slotID)
+	if err != nil {
+		return nil, err
+	}
+	if slot.Token == nil {
+		return nil, fmt.Errorf("%w: no token in slot %d", hsm.ErrTokenNotFound, slotID)
+	}
+	return slot.Token, nil
+}
+
+// checkPIN returns the slot's token after checking the PIN length against
+// the limits the token reports. The token is also returned when the length
+// is rejected, so that the rejection can be recorded with it.
+func checkPIN(provider string, slotID int, pin string) (*hsm.TokenInfo, error) {
+	slot, err := hsm.GetSlot(provider, slotID)
+	if err != nil {
+		return nil, err
+	}
+	token := slot.Token
+	if token == nil {
+		return nil, fmt.Errorf("%w: no token in slot %d", hsm.ErrTokenNotFound, slotID)
+	}
+	if token.MinPinLength > 0 && uint(len(pin)) < token.MinPinLength {
+		return token, fmt.Errorf("%w: NewPin must be at least %d characters", ErrInvalidRequest, token.MinPinLength)
+	}
+	if token.MaxPinLength > 0 && uint(len(pin)) > token.MaxPinLength {
+		return token, fmt.Errorf("%w: NewPin must be at most %d characters", ErrInvalidRequest, token.MaxPinLength)
+	}
+	return token, nil
+}
+
+// record writes the outcome of an operation to the ledger, including
+// requests rejected before reaching the token, and returns its result with
+// opErr. The result is nil when opErr is set, except for
+// ErrConfirmationRequired, whose result carries the token to confirm.
+func record(event string, provider string, slotID int, token *hsm.TokenInfo, extra map[string]interface{}, opErr error, bc *blockchain.Blockchain) (*Result, error) {
+	result := &Result{
+		Event:    event,
+		Provider: providerName(provider),
+		SlotID:   slotID,
+		Token:    token,
+		Time:     time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if bc != nil {
+		entry := map[string]interface{}{
+			"event":    event,
+			"provider": result.Provider,
+			"slot_id":  slotID,
+			"success":  opErr == nil,
+			"time":     result.Time,
+		}
+		if token != nil {
+			entry["token_label"] = token.Label
+			entry["token_serial"] = token.Serial
+		}
+		for k, v := range extra {
+			entry[k] = v
+		}
+		if opErr != nil {
+			entry["error"] = opErr.Error()
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s event: %w", event, err)
+		}
+		bc.AddBlock(string(data), "")
+	}
+
+	if errors.Is(opErr, ErrConfirmationRequired) {
+		return result, opErr
+	}
+	if opErr != nil {
+		return nil, opErr
+	}
+	return result, nil
+}
+
+// providerName resolves an empty provider name to the default provider
+func providerName(provider string) string {
+	if m, err := hsm.Lookup(provider); err == nil {
+		return m.Name()
+	}
+	return provider
+}
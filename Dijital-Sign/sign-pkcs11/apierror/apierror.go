@@ -0,0 +1,218 @@
+// Package apierror maps errors from the HSM and the service packages to HTTP
+// statuses and the error envelope every endpoint returns:
+//
+//	{"error": {"code": "pin_incorrect", "message": "...", "ckr": "CKR_PIN_INCORRECT"}}
+//
+// Codes are stable and meant for programs; messages are for people and may
+// change. ckr is present when a PKCS#11 call failed.
+package apierror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sign-pkcs11/admin"
+	"sign-pkcs11/auth"
+	"sign-pkcs11/hsm"
+	"sign-pkcs11/keys"
+	"sign-pkcs11/pki"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Error codes
+const (
+	CodeInvalidRequest       = "invalid_request"
+	CodeUnauthenticated      = "unauthenticated"
+	CodeForbidden            = "forbidden"
+	CodeInvalidToken         = "invalid_session_token"
+	CodeConfirmationRequired = "confirmation_required"
+	CodeProviderNotFound     = "provider_not_found"
+	CodeSlotNotFound         = "slot_not_found"
+	CodeTokenNotFound        = "token_not_found"
+	CodeKeyNotFound          = "key_not_found"
+	CodeCertificateNotFound  = "certificate_not_found"
+	CodeKeyReferenced        = "key_referenced"
+	CodeKeyAmbiguous         = "key_ambiguous"
+	CodeAlreadyRevoked       = "already_revoked"
+	CodeMechanismUnsupported = "mechanism_unsupported"
+	CodePinIncorrect         = "pin_incorrect"
+	CodePinLocked            = "pin_locked"
+	CodeTooManyAttempts      = "too_many_attempts"
+	CodePinExpired           = "pin_expired"
+	CodePinInvalid           = "pin_invalid"
+	CodePinNotInitialized    = "pin_not_initialized"
+	CodeNotLoggedIn          = "not_logged_in"
+	CodeLoginConflict        = "login_conflict"
+	CodeKeyHandleInvalid     = "key_handle_invalid"
+	CodeKeyUnusable          = "key_unusable"
+	CodeMechanismInvalid     = "mechanism_invalid"
+	CodeTemplateInvalid      = "template_invalid"
+	CodeAttributeProtected   = "attribute_protected"
+	CodeDataInvalid          = "data_invalid"
+	CodeSignatureInvalid     = "signature_invalid"
+	CodeTokenWriteProtected  = "token_write_protected"
+	CodeOperationActive      = "operation_active"
+	CodeFunctionNotSupported = "function_not_supported"
+	CodeDeviceMemory         = "device_memory"
+	CodeDeviceUnavailable    = "device_unavailable"
+	CodeSessionLimit         = "session_limit"
+	CodeNoHealthyMember      = "no_healthy_member"
+	CodeServiceUnavailable   = "service_unavailable"
+	CodeHSMError             = "hsm_error"
+	CodeInternal             = "internal_error"
+)
+
+// Error is the body of the error envelope
+type Error struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	CKR     string `json:"ckr,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// New returns an error with an explicit status and code
+func New(status int, code string, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+// mapping is the status and code of a PKCS#11 return value
+type mapping struct {
+	status int
+	code   string
+}
+
+// ckrMappings lists the return values with a status other than 502. Values
+// that are not listed are reported as hsm_error.
+var ckrMappings = map[pkcs11.Error]mapping{
+	pkcs11.CKR_PIN_INCORRECT:                  {http.StatusUnauthorized, CodePinIncorrect},
+	pkcs11.CKR_PIN_LOCKED:                     {http.StatusLocked, CodePinLocked},
+	pkcs11.CKR_PIN_EXPIRED:                    {http.StatusForbidden, CodePinExpired},
+	pkcs11.CKR_PIN_INVALID:                    {http.StatusBadRequest, CodePinInvalid},
+	pkcs11.CKR_PIN_LEN_RANGE:                  {http.StatusBadRequest, CodePinInvalid},
+	pkcs11.CKR_USER_PIN_NOT_INITIALIZED:       {http.StatusConflict, CodePinNotInitialized},
+	pkcs11.CKR_USER_NOT_LOGGED_IN:             {http.StatusUnauthorized, CodeNotLoggedIn},
+	pkcs11.CKR_USER_TYPE_INVALID:              {http.StatusBadRequest, CodeInvalidRequest},
+	pkcs11.CKR_USER_ALREADY_LOGGED_IN:         {http.StatusConflict, CodeLoginConflict},
+	pkcs11.CKR_USER_ANOTHER_ALREADY_LOGGED_IN: {http.StatusConflict, CodeLoginConflict},
+	pkcs11.CKR_USER_TOO_MANY_TYPES:            {http.StatusConflict, CodeLoginConflict},
+
+	pkcs11.CKR_KEY_HANDLE_INVALID:             {http.StatusNotFound, CodeKeyHandleInvalid},
+	pkcs11.CKR_OBJECT_HANDLE_INVALID:          {http.StatusNotFound, CodeKeyHandleInvalid},
+	pkcs11.CKR_WRAPPING_KEY_HANDLE_INVALID:    {http.StatusNotFound, CodeKeyHandleInvalid},
+	pkcs11.CKR_UNWRAPPING_KEY_HANDLE_INVALID:  {http.StatusNotFound, CodeKeyHandleInvalid},
+	pkcs11.CKR_KEY_TYPE_INCONSISTENT:          {http.StatusUnprocessableEntity, CodeKeyUnusable},
+	pkcs11.CKR_KEY_FUNCTION_NOT_PERMITTED:     {http.StatusUnprocessableEntity, CodeKeyUnusable},
+	pkcs11.CKR_KEY_SIZE_RANGE:                 {http.StatusUnprocessableEntity, CodeKeyUnusable},
+	pkcs11.CKR_KEY_UNEXTRACTABLE:              {http.StatusUnprocessableEntity, CodeKeyUnusable},
+	pkcs11.CKR_KEY_NOT_WRAPPABLE:              {http.StatusUnprocessableEntity, CodeKeyUnusable},
+	pkcs11.CKR_WRAPPING_KEY_TYPE_INCONSISTENT: {http.StatusUnprocessableEntity, CodeKeyUnusable},
+	pkcs11.CKR_WRAPPING_KEY_SIZE_RANGE:        {http.StatusUnprocessableEntity, CodeKeyUnusable},
+	pkcs11.CKR_MECHANISM_INVALID:              {http.StatusUnprocessableEntity, CodeMechanismInvalid},
+	pkcs11.CKR_MECHANISM_PARAM_INVALID:        {http.StatusUnprocessableEntity, CodeMechanismInvalid},
+	pkcs11.CKR_ATTRIBUTE_TYPE_INVALID:         {http.StatusUnprocessableEntity, CodeTemplateInvalid},
+	pkcs11.CKR_ATTRIBUTE_VALUE_INVALID:        {http.StatusUnprocessableEntity, CodeTemplateInvalid},
+	pkcs11.CKR_TEMPLATE_INCOMPLETE:            {http.StatusUnprocessableEntity, CodeTemplateInvalid},
+	pkcs11.CKR_TEMPLATE_INCONSISTENT:          {http.StatusUnprocessableEntity, CodeTemplateInvalid},
+	pkcs11.CKR_DOMAIN_PARAMS_INVALID:          {http.StatusUnprocessableEntity, CodeTemplateInvalid},
+	pkcs11.CKR_CURVE_NOT_SUPPORTED:            {http.StatusUnprocessableEntity, CodeTemplateInvalid},
+	pkcs11.CKR_ATTRIBUTE_READ_ONLY:            {http.StatusForbidden, CodeAttributeProtected},
+	pkcs11.CKR_ATTRIBUTE_SENSITIVE:            {http.StatusForbidden, CodeAttributeProtected},
+
+	pkcs11.CKR_ARGUMENTS_BAD:            {http.StatusBadRequest, CodeDataInvalid},
+	pkcs11.CKR_DATA_INVALID:             {http.StatusBadRequest, CodeDataInvalid},
+	pkcs11.CKR_DATA_LEN_RANGE:           {http.StatusBadRequest, CodeDataInvalid},
+	pkcs11.CKR_ENCRYPTED_DATA_INVALID:   {http.StatusBadRequest, CodeDataInvalid},
+	pkcs11.CKR_ENCRYPTED_DATA_LEN_RANGE: {http.StatusBadRequest, CodeDataInvalid},
+	pkcs11.CKR_WRAPPED_KEY_INVALID:      {http.StatusBadRequest, CodeDataInvalid},
+	pkcs11.CKR_WRAPPED_KEY_LEN_RANGE:    {http.StatusBadRequest, CodeDataInvalid},
+	pkcs11.CKR_SIGNATURE_INVALID:        {http.StatusUnprocessableEntity, CodeSignatureInvalid},
+	pkcs11.CKR_SIGNATURE_LEN_RANGE:      {http.StatusUnprocessableEntity, CodeSignatureInvalid},
+
+	pkcs11.CKR_TOKEN_WRITE_PROTECTED:  {http.StatusForbidden, CodeTokenWriteProtected},
+	pkcs11.CKR_SESSION_READ_ONLY:      {http.StatusForbidden, CodeTokenWriteProtected},
+	pkcs11.CKR_OPERATION_ACTIVE:       {http.StatusConflict, CodeOperationActive},
+	pkcs11.CKR_FUNCTION_NOT_SUPPORTED: {http.StatusNotImplemented, CodeFunctionNotSupported},
+	pkcs11.CKR_SLOT_ID_INVALID:        {http.StatusNotFound, CodeSlotNotFound},
+
+	pkcs11.CKR_DEVICE_MEMORY:            {http.StatusInsufficientStorage, CodeDeviceMemory},
+	pkcs11.CKR_HOST_MEMORY:              {http.StatusServiceUnavailable, CodeServiceUnavailable},
+	pkcs11.CKR_SESSION_COUNT:            {http.StatusServiceUnavailable, CodeSessionLimit},
+	pkcs11.CKR_DEVICE_ERROR:             {http.StatusServiceUnavailable, CodeDeviceUnavailable},
+	pkcs11.CKR_DEVICE_REMOVED:           {http.StatusServiceUnavailable, CodeDeviceUnavailable},
+	pkcs11.CKR_TOKEN_NOT_PRESENT:        {http.StatusServiceUnavailable, CodeDeviceUnavailable},
+	pkcs11.CKR_TOKEN_NOT_RECOGNIZED:     {http.StatusServiceUnavailable, CodeDeviceUnavailable},
+	pkcs11.CKR_SESSION_CLOSED:           {http.StatusServiceUnavailable, CodeDeviceUnavailable},
+	pkcs11.CKR_SESSION_HANDLE_INVALID:   {http.StatusServiceUnavailable, CodeDeviceUnavailable},
+	pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED: {http.StatusServiceUnavailable, CodeDeviceUnavailable},
+}
+
+// sentinel is a service error with a fixed status and code
+type sentinel struct {
+	err    error
+	status int
+	code   string
+}
+
+// sentinels are checked before PKCS#11 return values, since they describe
+// the failure more precisely than the return value they may wrap
+var sentinels = []sentinel{
+	{hsm.ErrInvalidRequest, http.StatusBadRequest, CodeInvalidRequest},
+	{admin.ErrConfirmationRequired, http.StatusPreconditionRequired, CodeConfirmationRequired},
+	{auth.ErrInvalidToken, http.StatusUnauthorized, CodeInvalidToken},
+	{auth.ErrTooManyAttempts, http.StatusTooManyRequests, CodeTooManyAttempts},
+	{hsm.ErrProviderNotFound, http.StatusNotFound, CodeProviderNotFound},
+	{hsm.ErrTokenNotFound, http.StatusNotFound, CodeTokenNotFound},
+	{hsm.ErrMechanismUnsupported, http.StatusUnprocessableEntity, CodeMechanismUnsupported},
+	{hsm.ErrNoHealthyMember, http.StatusServiceUnavailable, CodeNoHealthyMember},
+	{hsm.ErrNoFreeSession, http.StatusServiceUnavailable, CodeSessionLimit},
+	{hsm.ErrReconnectFailed, http.StatusServiceUnavailable, CodeDeviceUnavailable},
+	{hsm.ErrManagerClosed, http.StatusServiceUnavailable, CodeServiceUnavailable},
+	{keys.ErrKeyNotFound, http.StatusNotFound, CodeKeyNotFound},
+	{keys.ErrKeyReferenced, http.StatusConflict, CodeKeyReferenced},
+	{keys.ErrKeyAmbiguous, http.StatusConflict, CodeKeyAmbiguous},
+	{pki.ErrCertificateNotFound, http.StatusNotFound, CodeCertificateNotFound},
+	{pki.ErrAlreadyRevoked, http.StatusConflict, CodeAlreadyRevoked},
+}
+
+// From classifies an error. Service errors and PKCS#11 return values get
+// their own status and code; anything else is a 500 internal_error.
+func From(err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	e := &Error{Status: http.StatusInternalServerError, Code: CodeInternal, Message: err.Error()}
+	var ckr pkcs11.Error
+	if errors.As(err, &ckr) {
+		e.CKR = CKRName(ckr)
+		e.Status, e.Code = http.StatusBadGateway, CodeHSMError
+		if m, ok := ckrMappings[ckr]; ok {
+			e.Status, e.Code = m.status, m.code
+		}
+	}
+	for _, s := range sentinels {
+		if errors.Is(err, s.err) {
+			e.Status, e.Code = s.status, s.code
+			break
+		}
+	}
+	return e
+}
+
+// CKRName returns the name of a PKCS#11 return value, such as
+// CKR_PIN_INCORRECT, or its hexadecimal value when the name is unknown
+func CKRName(ckr pkcs11.Error) string {
+	// pkcs11.Error formats as "pkcs11: 0xA0: CKR_PIN_INCORRECT"
+	msg := ckr.Error()
+	if i := strings.LastIndex(msg, ": "); i >= 0 && strings.HasPrefix(msg[i+2:], "CKR_") {
+		return msg[i+2:]
+	}
+	return fmt.Sprintf("0x%X", uint(ckr))
+}
@@ -0,0 +1,98 @@
+package apierror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sign-pkcs11/admin"
+	"sign-pkcs11/auth"
+	"sign-pkcs11/create"
+	"sign-pkcs11/hsm"
+	"sign-pkcs11/keys"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+func TestFrom(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+		ckr    string
+	}{
+		{"pin incorrect", pkcs11.Error(pkcs11.CKR_PIN_INCORRECT), http.StatusUnauthorized, CodePinIncorrect, "CKR_PIN_INCORRECT"},
+		{"pin locked", pkcs11.Error(pkcs11.CKR_PIN_LOCKED), http.StatusLocked, CodePinLocked, "CKR_PIN_LOCKED"},
+		{"pin length", pkcs11.Error(pkcs11.CKR_PIN_LEN_RANGE), http.StatusBadRequest, CodePinInvalid, "CKR_PIN_LEN_RANGE"},
+		{"wrapped ckr", fmt.Errorf("failed to log in: %w", pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN)), http.StatusUnauthorized, CodeNotLoggedIn, "CKR_USER_NOT_LOGGED_IN"},
+		{"key handle", pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID), http.StatusNotFound, CodeKeyHandleInvalid, "CKR_OBJECT_HANDLE_INVALID"},
+		{"mechanism", pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID), http.StatusUnprocessableEntity, CodeMechanismInvalid, "CKR_MECHANISM_INVALID"},
+		{"signature", pkcs11.Error(pkcs11.CKR_SIGNATURE_INVALID), http.StatusUnprocessableEntity, CodeSignatureInvalid, "CKR_SIGNATURE_INVALID"},
+		{"device error", pkcs11.Error(pkcs11.CKR_DEVICE_ERROR), http.StatusServiceUnavailable, CodeDeviceUnavailable, "CKR_DEVICE_ERROR"},
+		{"session limit", pkcs11.Error(pkcs11.CKR_SESSION_COUNT), http.StatusServiceUnavailable, CodeSessionLimit, "CKR_SESSION_COUNT"},
+		{"unmapped ckr", pkcs11.Error(pkcs11.CKR_GENERAL_ERROR), http.StatusBadGateway, CodeHSMError, "CKR_GENERAL_ERROR"},
+		{"plain error", errors.New("boom"), http.StatusInternalServerError, CodeInternal, ""},
+		{"key not found", fmt.Errorf("label x: %w", keys.ErrKeyNotFound), http.StatusNotFound, CodeKeyNotFound, ""},
+		{"invalid request", fmt.Errorf("%w: OldPin and NewPin are required", admin.ErrInvalidRequest), http.StatusBadRequest, CodeInvalidRequest, ""},
+		// Validation errors are returned before the token is opened
+		{"unknown profile", rsaError(2048, "no-such-profile"), http.StatusBadRequest, CodeInvalidRequest, ""},
+		{"rsa key size", rsaError(0, ""), http.StatusBadRequest, CodeInvalidRequest, ""},
+		{"ec curve", ecError("P-192"), http.StatusBadRequest, CodeInvalidRequest, ""},
+		{"delete without label", deleteError(), http.StatusBadRequest, CodeInvalidRequest, ""},
+		{"export format", exportError("pkcs1"), http.StatusBadRequest, CodeInvalidRequest, ""},
+		{"key ambiguous", fmt.Errorf("%w: 2 public and 2 private keys match", keys.ErrKeyAmbiguous), http.StatusConflict, CodeKeyAmbiguous, ""},
+		{"too many attempts", fmt.Errorf("%w: retry in 5m0s", auth.ErrTooManyAttempts), http.StatusTooManyRequests, CodeTooManyAttempts, ""},
+		{"no free session", hsm.ErrNoFreeSession, http.StatusServiceUnavailable, CodeSessionLimit, ""},
+		{"explicit", New(http.StatusForbidden, CodeForbidden, "no"), http.StatusForbidden, CodeForbidden, ""},
+		// A sentinel wins over the PKCS#11 value it wraps
+		{"reconnect failed", fmt.Errorf("%w: slot 0: %w", hsm.ErrReconnectFailed, pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)), http.StatusServiceUnavailable, CodeDeviceUnavailable, "CKR_PIN_INCORRECT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := From(tt.err)
+			if got.Status != tt.status || got.Code != tt.code || got.CKR != tt.ckr {
+				t.Errorf("From(%v) = %d %s %q, want %d %s %q", tt.err, got.Status, got.Code, got.CKR, tt.status, tt.code, tt.ckr)
+			}
+			if got.Message != tt.err.Error() {
+				t.Errorf("Message = %q, want %q", got.Message, tt.err.Error())
+			}
+		})
+	}
+}
+
+func rsaError(keySize int, profile string) error {
+	_, err := create.GenerateRSAKey("", 0, "", keySize, "label", "", profile)
+	return err
+}
+
+func ecError(curve string) error {
+	_, err := create.GenerateECKey("", 0, "", curve, "label", "", "")
+	return err
+}
+
+func deleteError() error {
+	_, err := keys.DeleteKeyPair("", 0, "", "", "", false, false, nil)
+	return err
+}
+
+func exportError(format string) error {
+	_, err := keys.ExportPublicKey("", 0, "", "label", "", format)
+	return err
+}
+
+func TestCKRName(t *testing.T) {
+	tests := []struct {
+		ckr  pkcs11.Error
+		want string
+	}{
+		{pkcs11.CKR_PIN_INCORRECT, "CKR_PIN_INCORRECT"},
+		{pkcs11.CKR_DEVICE_REMOVED, "CKR_DEVICE_REMOVED"},
+		{pkcs11.Error(0x8000ABCD), "0x8000ABCD"},
+	}
+	for _, tt := range tests {
+		if got := CKRName(tt.ckr); got != tt.want {
+			t.Errorf("CKRName(%#x) = %q, want %q", uint(tt.ckr), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Defaults for the PIN failure limit
+const (
+	DefaultPINFailures = 5
+	DefaultPINWindow   = 15 * time.Minute
+)
+
+// maxTrackedCallers bounds the limiter's map before stale entries are swept
+const maxTrackedCallers = 1024
+
+// ErrTooManyAttempts is returned by Allow while a caller is locked out
+var ErrTooManyAttempts = errors.New("too many wrong PINs")
+
+// Limiter counts wrong PINs per caller. A slot's session pool answers wrong
+// PINs itself, so they never reach the token's retry counter; the limiter
+// stands in for it without affecting other callers of the slot.
+type Limiter struct {
+	max    int
+	window time.Duration
+
+	mu       sync.Mutex
+	failures map[string][]time.Time // failure times within the window, oldest first
+}
+
+// NewLimiter creates a limiter that locks a caller out once it sent max
+// wrong PINs within window, until the oldest of them leaves the window
+func NewLimiter(max int, window time.Duration) *Limiter {
+	if max <= 0 {
+		max = DefaultPINFailures
+	}
+	if window <= 0 {
+		window = DefaultPINWindow
+	}
+	return &Limiter{max: max, window: window, failures: map[string][]time.Time{}}
+}
+
+// Allow returns ErrTooManyAttempts, with the time left, while the caller is
+// locked out
+func (l *Limiter) Allow(caller string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	recent := l.prune(caller, now)
+	if len(recent) < l.max {
+		return nil
+	}
+	wait := recent[len(recent)-l.max].Add(l.window).Sub(now)
+	return fmt.Errorf("%w: retry in %s", ErrTooManyAttempts, wait.Round(time.Second))
+}
+
+// Fail records a wrong PIN sent by the caller
+func (l *Limiter) Fail(caller string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if len(l.failures) >= maxTrackedCallers {
+		for other := range l.failures {
+			l.prune(other, now)
+		}
+	}
+	l.failures[caller] = append(l.prune(caller, now), now)
+}
+
+// prune drops the caller's failures older than the window and returns the
+// rest. Callers left without failures are removed from the map.
+func (l *Limiter) prune(caller string, now time.Time) []time.Time {
+	times := l.failures[caller]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= l.window {
+		i++
+	}
+	times = times[i:]
+	if len(times) == 0 {
+		delete(l.failures, caller)
+		return nil
+	}
+	l.failures[caller] = times
+	return times
+}
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(3, time.Minute)
+	for i := 0; i < 2; i++ {
+		l.Fail("10.0.0.1")
+	}
+	if err := l.Allow("10.0.0.1"); err != nil {
+		t.Fatalf("Allow after 2 of 3 failures: %v", err)
+	}
+	l.Fail("10.0.0.1")
+	if err := l.Allow("10.0.0.1"); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("Allow after 3 failures: %v, want ErrTooManyAttempts", err)
+	}
+	if err := l.Allow("10.0.0.2"); err != nil {
+		t.Errorf("Allow for another caller: %v", err)
+	}
+
+	// Failures leave the window one by one
+	now := time.Now()
+	l.failures["10.0.0.1"] = []time.Time{now.Add(-2 * time.Minute), now.Add(-30 * time.Second), now.Add(-10 * time.Second)}
+	if err := l.Allow("10.0.0.1"); err != nil {
+		t.Errorf("Allow after the oldest failure expired: %v", err)
+	}
+	l.failures["10.0.0.1"] = []time.Time{now.Add(-2 * time.Minute)}
+	if err := l.Allow("10.0.0.1"); err != nil {
+		t.Errorf("Allow after every failure expired: %v", err)
+	}
+	if _, ok := l.failures["10.0.0.1"]; ok {
+		t.Error("caller without recent failures is still tracked")
+	}
+}
@@ -0,0 +1,256 @@
+// Package auth issues short-lived session tokens so clients log in to a slot
+// once instead of sending the PIN with every request.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sign-pkcs11/hsm"
+	"sync"
+	"time"
+)
+
+// Defaults used unless SESSION_IDLE_TIMEOUT and SESSION_MAX_LIFETIME say
+// otherwise
+const (
+	DefaultIdleTimeout = 15 * time.Minute
+	DefaultMaxLifetime = 8 * time.Hour
+)
+
+// tokenBytes is the number of random bytes in a session token
+const tokenBytes = 32
+
+// ErrInvalidToken is returned for unknown, expired or logged out tokens
+var ErrInvalidToken = errors.New("invalid or expired session token")
+
+// Config holds the session lifetimes
+type Config struct {
+	IdleTimeout time.Duration // a session unused for this long expires
+	MaxLifetime time.Duration // a session expires this long after login
+}
+
+// ConfigFromEnv reads SESSION_IDLE_TIMEOUT and SESSION_MAX_LIFETIME as Go
+// durations
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{IdleTimeout: DefaultIdleTimeout, MaxLifetime: DefaultMaxLifetime}
+	for name, target := range map[string]*time.Duration{
+		"SESSION_IDLE_TIMEOUT": &cfg.IdleTimeout,
+		"SESSION_MAX_LIFETIME": &cfg.MaxLifetime,
+	} {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid %s: %s", name, v)
+		}
+		*target = d
+	}
+	return cfg, nil
+}
+
+// Session is a logged-in client bound to one slot
+type Session struct {
+	ID            string    `json:"id"`
+	Provider      string    `json:"provider"`
+	SlotID        int       `json:"slot_id"`
+	CreatedAt     time.Time `json:"created_at"`
+	LastUsed      time.Time `json:"last_used"`
+	IdleExpiresAt time.Time `json:"idle_expires_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+
+	pin string
+}
+
+// PIN returns the user PIN the session logged in with
+func (s *Session) PIN() string {
+	return s.pin
+}
+
+// LoginResult is returned once by Login; the token is not stored
+type LoginResult struct {
+	Token string `json:"token"`
+	*Session
+}
+
+// Store keeps the active sessions in memory. Only the SHA-256 hash of each
+// token is kept, so the tokens cannot be read back from the store. The PIN
+// is kept because the slot's session pool checks it on every borrow.
+type Store struct {
+	config Config
+	stop   chan struct{}
+
+	mu       sync.Mutex
+	sessions map[string]*Session // keyed by token hash
+}
+
+// NewStore creates a store and starts removing expired sessions in the
+// background until Close
+func NewStore(cfg Config) *Store {
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = DefaultIdleTimeout
+	}
+	if cfg.MaxLifetime <= 0 {
+		cfg.MaxLifetime = DefaultMaxLifetime
+	}
+	st := &Store{config: cfg, stop: make(chan struct{}), sessions: map[string]*Session{}}
+	go st.expire()
+	return st
+}
+
+// Login checks the PIN by borrowing a session on the slot and returns a new
+// session token bound to the provider and slot
+func (st *Store) Login(provider string, slotID int, pin string) (*LoginResult, error) {
+	if pin == "" {
+		return nil, fmt.Errorf("UserPin is required")
+	}
+	s, err := hsm.Open(provider, slotID, pin)
+	if err != nil {
+		return nil, err
+	}
+	s.Close()
+
+	raw := make([]byte, tokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate session token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	hash := tokenHash(token)
+
+	now := time.Now().UTC()
+	session := &Session{
+		ID:        hash[:16],
+		Provider:  provider,
+		SlotID:    slotID,
+		CreatedAt: now,
+		LastUsed:  now,
+		ExpiresAt: now.Add(st.config.MaxLifetime),
+		pin:       pin,
+	}
+	session.IdleExpiresAt = st.idleExpiry(session)
+
+	st.mu.Lock()
+	st.sessions[hash] = session
+	st.mu.Unlock()
+
+	info := *session
+	return &LoginResult{Token: token, Session: &info}, nil
+}
+
+// Lookup returns a copy of the token's session and marks it as used
+func (st *Store) Lookup(token string) (*Session, error) {
+	hash := tokenHash(token)
+	now := time.Now().UTC()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	session, ok := st.sessions[hash]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	if st.expired(session, now) {
+		delete(st.sessions, hash)
+		return nil, ErrInvalidToken
+	}
+	session.LastUsed = now
+	session.IdleExpiresAt = st.idleExpiry(session)
+
+	info := *session
+	return &info, nil
+}
+
+// Logout revokes a token
+func (st *Store) Logout(token string) error {
+	hash := tokenHash(token)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.sessions[hash]; !ok {
+		return ErrInvalidToken
+	}
+	delete(st.sessions, hash)
+	return nil
+}
+
+// RevokeSlot revokes every session bound to a slot, for instance after its
+// user PIN changed, and returns how many were revoked. An empty provider
+// name stands for the default provider.
+func (st *Store) RevokeSlot(provider string, slotID int) int {
+	defaultName := ""
+	if m, err := hsm.Default(); err == nil {
+		defaultName = m.Name()
+	}
+	canonical := func(name string) string {
+		if name == "" {
+			return defaultName
+		}
+		return name
+	}
+	provider = canonical(provider)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	revoked := 0
+	for hash, session := range st.sessions {
+		if session.SlotID == slotID && canonical(session.Provider) == provider {
+			delete(st.sessions, hash)
+			revoked++
+		}
+	}
+	return revoked
+}
+
+// Close stops the background expiry
+func (st *Store) Close() {
+	close(st.stop)
+}
+
+// expire removes expired sessions every minute
+func (st *Store) expire() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			st.mu.Lock()
+			for hash, session := range st.sessions {
+				if st.expired(session, now.UTC()) {
+					delete(st.sessions, hash)
+				}
+			}
+			st.mu.Unlock()
+		case <-st.stop:
+			return
+		}
+	}
+}
+
+// expired reports whether the session ran past its idle timeout or lifetime
+func (st *Store) expired(session *Session, now time.Time) bool {
+	return !now.Before(session.IdleExpiresAt) || !now.Before(session.ExpiresAt)
+}
+
+// idleExpiry returns when the session expires if it is not used again,
+// never later than its lifetime
+func (st *Store) idleExpiry(session *Session) time.Time {
+	idle := session.LastUsed.Add(st.config.IdleTimeout)
+	if idle.After(session.ExpiresAt) {
+		return session.ExpiresAt
+	}
+	return idle
+}
+
+// tokenHash is the key a token is stored under
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// addSession stores a session as Login would, without the HSM
+func addSession(st *Store, token string, provider string, slotID int, created time.Time, lastUsed time.Time) {
+	session := &Session{
+		ID:        tokenHash(token)[:16],
+		Provider:  provider,
+		SlotID:    slotID,
+		CreatedAt: created,
+		LastUsed:  lastUsed,
+		ExpiresAt: created.Add(st.config.MaxLifetime),
+		pin:       "1234",
+	}
+	session.IdleExpiresAt = st.idleExpiry(session)
+	st.sessions[tokenHash(token)] = session
+}
+
+func TestLookupExpiry(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name     string
+		created  time.Time
+		lastUsed time.Time
+		valid    bool
+	}{
+		{"fresh", now.Add(-time.Minute), now.Add(-time.Minute), true},
+		{"used within idle timeout", now.Add(-2 * time.Hour), now.Add(-14 * time.Minute), true},
+		{"idle too long", now.Add(-2 * time.Hour), now.Add(-16 * time.Minute), false},
+		{"past lifetime though recently used", now.Add(-8*time.Hour - time.Minute), now.Add(-time.Minute), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := NewStore(Config{IdleTimeout: 15 * time.Minute, MaxLifetime: 8 * time.Hour})
+			defer st.Close()
+			addSession(st, "token", "softhsm", 1, tt.created, tt.lastUsed)
+
+			session, err := st.Lookup("token")
+			if !tt.valid {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("Lookup error = %v, want ErrInvalidToken", err)
+				}
+				if len(st.sessions) != 0 {
+					t.Error("expired session was not removed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Lookup: %v", err)
+			}
+			if session.PIN() != "1234" || session.Provider != "softhsm" || session.SlotID != 1 {
+				t.Errorf("Lookup = %+v", session)
+			}
+			if session.LastUsed.Before(now) {
+				t.Errorf("LastUsed = %v, want it refreshed", session.LastUsed)
+			}
+			if session.IdleExpiresAt.After(session.ExpiresAt) {
+				t.Errorf("IdleExpiresAt %v is after ExpiresAt %v", session.IdleExpiresAt, session.ExpiresAt)
+			}
+		})
+	}
+}
+
+func TestIdleExpiryCappedByLifetime(t *testing.T) {
+	st := NewStore(Config{IdleTimeout: time.Hour, MaxLifetime: 90 * time.Minute})
+	defer st.Close()
+
+	now := time.Now().UTC()
+	created := now.Add(-80 * time.Minute)
+	addSession(st, "token", "softhsm", 0, created, now.Add(-time.Minute))
+	session, err := st.Lookup("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := created.Add(90 * time.Minute); !session.IdleExpiresAt.Equal(want) {
+		t.Errorf("IdleExpiresAt = %v, want %v", session.IdleExpiresAt, want)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	st := NewStore(Config{})
+	defer st.Close()
+	now := time.Now().UTC()
+	addSession(st, "token", "softhsm", 0, now, now)
+
+	if err := st.Logout("token"); err != nil {
+		t.Fatalf("Logout: %v", err)
+	}
+	if _, err := st.Lookup("token"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Lookup after Logout error = %v, want ErrInvalidToken", err)
+	}
+	if err := st.Logout("token"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("second Logout error = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestRevokeSlot(t *testing.T) {
+	now := time.Now().UTC()
+	sessions := []struct {
+		token    string
+		provider string
+		slotID   int
+	}{
+		{"a", "softhsm", 1},
+		{"b", "softhsm", 1},
+		{"c", "softhsm", 2},
+		{"d", "procrypt", 1},
+	}
+	tests := []struct {
+		provider string
+		slotID   int
+		revoked  int
+		left     []string
+	}{
+		{"softhsm", 1, 2, []string{"c", "d"}},
+		{"softhsm", 2, 1, []string{"a", "b", "d"}},
+		{"procrypt", 1, 1, []string{"a", "b", "c"}},
+		{"softhsm", 3, 0, []string{"a", "b", "c", "d"}},
+	}
+	for _, tt := range tests {
+		st := NewStore(Config{})
+		for _, s := range sessions {
+			addSession(st, s.token, s.provider, s.slotID, now, now)
+		}
+		if got := st.RevokeSlot(tt.provider, tt.slotID); got != tt.revoked {
+			t.Errorf("RevokeSlot(%s, %d) = %d, want %d", tt.provider, tt.slotID, got, tt.revoked)
+		}
+		for _, token := range tt.left {
+			if _, err := st.Lookup(token); err != nil {
+				t.Errorf("RevokeSlot(%s, %d) revoked token %s", tt.provider, tt.slotID, token)
+			}
+		}
+		if len(st.sessions) != len(tt.left) {
+			t.Errorf("RevokeSlot(%s, %d) left %d sessions, want %d", tt.provider, tt.slotID, len(st.sessions), len(tt.left))
+		}
+		st.Close()
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		idle, lifetime string
+		want           Config
+		wantErr        bool
+	}{
+		{"", "", Config{IdleTimeout: DefaultIdleTimeout, MaxLifetime: DefaultMaxLifetime}, false},
+		{"5m", "1h", Config{IdleTimeout: 5 * time.Minute, MaxLifetime: time.Hour}, false},
+		{"0s", "", Config{}, true},
+		{"soon", "", Config{}, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("SESSION_IDLE_TIMEOUT", tt.idle)
+		t.Setenv("SESSION_MAX_LIFETIME", tt.lifetime)
+		got, err := ConfigFromEnv()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ConfigFromEnv(%q, %q) error = %v, wantErr %v", tt.idle, tt.lifetime, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("ConfigFromEnv(%q, %q) = %+v, want %+v", tt.idle, tt.lifetime, got, tt.want)
+		}
+	}
+}
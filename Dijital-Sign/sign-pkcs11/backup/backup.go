@@ -0,0 +1,234 @@
+// Package backup exports private keys wrapped under an AES key-encryption
+// key held on the token and restores them on the same or another slot.
+package backup
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sign-pkcs11/hsm"
+	"strings"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// BundleVersion is the format version written into new bundles
+const BundleVersion = 1
+
+// wrapMechanism is the only wrapping mechanism bundles are produced with
+const wrapMechanism = "CKM_AES_KEY_WRAP_PAD"
+
+// Bundle is a versioned set of wrapped private keys and their public halves
+type Bundle struct {
+	Version      int         `json:"version"`
+	CreatedAt    time.Time   `json:"created_at"`
+	WrapKeyLabel string      `json:"wrap_key_label"`
+	Mechanism    string      `json:"mechanism"`
+	Keys         []BundleKey `json:"keys"`
+}
+
+// BundleKey is a single wrapped private key with the attributes needed to
+// recreate it
+type BundleKey struct {
+	PrivateKeyLabel string          `json:"private_key_label"`
+	PublicKeyLabel  string          `json:"public_key_label"`
+	KeyID           string          `json:"key_id"`
+	KeyType         string          `json:"key_type"`
+	ECParams        string          `json:"ec_params,omitempty"`
+	Attributes      map[string]bool `json:"attributes"`
+	WrappedKey      string          `json:"wrapped_key"`
+	PublicKey       string          `json:"public_key"`
+}
+
+// copiedAttributes are read from the private key on backup and set on the
+// unwrapped key on restore
+var copiedAttributes = map[string]uint{
+	"sign":        pkcs11.CKA_SIGN,
+	"decrypt":     pkcs11.CKA_DECRYPT,
+	"unwrap":      pkcs11.CKA_UNWRAP,
+	"derive":      pkcs11.CKA_DERIVE,
+	"sensitive":   pkcs11.CKA_SENSITIVE,
+	"extractable": pkcs11.CKA_EXTRACTABLE,
+}
+
+// WrapKeyOptions controls how the key-encryption key is obtained
+type WrapKeyOptions struct {
+	Label  string
+	Create bool // generate the key on the token when no key with Label exists
+}
+
+// Backup wraps the private keys with the given labels under the AES wrapping
+// key and returns the bundle. Labels may be the base label of a generated
+// pair or the "_priv" label itself; the keys must be extractable.
+func Backup(provider string, slotID int, userPin string, wrapKey WrapKeyOptions, keyLabels []string) (*Bundle, error) {
+	if len(keyLabels) == 0 {
+		return nil, fmt.Errorf("at least one key label is required")
+	}
+
+	if err := hsm.CheckMechanism(provider, slotID, pkcs11.CKM_AES_KEY_WRAP_PAD, pkcs11.CKF_WRAP, 0); err != nil {
+		return nil, err
+	}
+
+	s, err := hsm.Open(provider, slotID, userPin)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	kek, err := wrappingKey(s, wrapKey)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &Bundle{
+		Version:      BundleVersion,
+		CreatedAt:    time.Now().UTC(),
+		WrapKeyLabel: wrapKey.Label,
+		Mechanism:    wrapMechanism,
+		Keys:         []BundleKey{},
+	}
+
+	for _, label := range keyLabels {
+		key, err := backupKey(s, kek, label)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", label, err)
+		}
+		bundle.Keys = append(bundle.Keys, *key)
+	}
+	return bundle, nil
+}
+
+// backupKey wraps one private key and collects its attributes and public key
+func backupKey(s *hsm.Session, kek pkcs11.ObjectHandle, label string) (*BundleKey, error) {
+	privLabel := label
+	if !strings.HasSuffix(label, "_priv") {
+		privLabel = label + "_priv"
+	}
+
+	priv, err := findOne(s, pkcs11.CKO_PRIVATE_KEY, privLabel, nil)
+	if err != nil {
+		// Fall back to the label exactly as given
+		if priv, err = findOne(s, pkcs11.CKO_PRIVATE_KEY, label, nil); err != nil {
+			return nil, err
+		}
+		privLabel = label
+	}
+
+	if v, err := s.Attribute(priv, pkcs11.CKA_EXTRACTABLE); err != nil || !hsm.Bool(v) {
+		return nil, fmt.Errorf("private key is not extractable, generate it with the exportable-backup profile")
+	}
+
+	key := &BundleKey{PrivateKeyLabel: privLabel, Attributes: map[string]bool{}}
+	if v, err := s.Attribute(priv, pkcs11.CKA_ID); err == nil {
+		key.KeyID = hex.EncodeToString(v)
+	}
+	v, err := s.Attribute(priv, pkcs11.CKA_KEY_TYPE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key type: %w", err)
+	}
+	keyType := hsm.Ulong(v)
+	key.KeyType = hsm.KeyTypeNames[keyType]
+	if keyType == pkcs11.CKK_EC || keyType == hsm.CKK_EC_EDWARDS {
+		params, err := s.Attribute(priv, pkcs11.CKA_EC_PARAMS)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read EC parameters: %w", err)
+		}
+		key.ECParams = hex.EncodeToString(params)
+	}
+	for name, typ := range copiedAttributes {
+		if v, err := s.Attribute(priv, typ); err == nil {
+			key.Attributes[name] = hsm.Bool(v)
+		}
+	}
+
+	wrapped, err := s.Ctx.WrapKey(s.Handle, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP_PAD, nil)}, kek, priv)
+	if err != nil {
+		return nil, fmt.Errorf("WrapKey failed: %w", err)
+	}
+	key.WrappedKey = base64.StdEncoding.EncodeToString(wrapped)
+
+	// The public key is stored in the clear so it can be recreated on restore
+	pubLabel := strings.TrimSuffix(privLabel, "_priv") + "_pub"
+	var keyID []byte
+	if key.KeyID != "" {
+		keyID, _ = hex.DecodeString(key.KeyID)
+	}
+	pubHandle, err := findOne(s, pkcs11.CKO_PUBLIC_KEY, pubLabel, keyID)
+	if err != nil {
+		// Tokens usually expose the public components on the private key too
+		pubHandle, pubLabel = priv, ""
+	}
+	pub, err := s.PublicKey(pubHandle)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %w", err)
+	}
+	key.PublicKeyLabel = pubLabel
+	key.PublicKey = base64.StdEncoding.EncodeToString(der)
+	return key, nil
+}
+
+// wrappingKey finds the AES key-encryption key by label, generating it on
+// the token when requested and absent. Key material is never accepted from
+// the caller.
+func wrappingKey(s *hsm.Session, opts WrapKeyOptions) (pkcs11.ObjectHandle, error) {
+	if opts.Label == "" {
+		return 0, fmt.Errorf("wrap key label is required")
+	}
+
+	handle, err := findOne(s, pkcs11.CKO_SECRET_KEY, opts.Label, nil)
+	if err == nil {
+		return handle, nil
+	}
+	if !opts.Create {
+		return 0, fmt.Errorf("wrap key %s not found: %w", opts.Label, err)
+	}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, opts.Label),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, false),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, false),
+	}
+
+	template = append(template, pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, 32))
+	handle, err = s.Ctx.GenerateKey(s.Handle, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_GEN, nil)}, template)
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate wrap key: %w", err)
+	}
+	return handle, nil
+}
+
+// findOne returns the single object of the class with the label (and ID, if given)
+func findOne(s *hsm.Session, class uint, label string, id []byte) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if len(id) > 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+	}
+	handles, err := s.FindObjects(template)
+	if err != nil {
+		return 0, err
+	}
+	switch len(handles) {
+	case 0:
+		return 0, fmt.Errorf("no %s object labelled %s", hsm.ClassNames[class], label)
+	case 1:
+		return handles[0], nil
+	}
+	return 0, fmt.Errorf("%d %s objects labelled %s, label is ambiguous", len(handles), hsm.ClassNames[class], label)
+}
@@ -0,0 +1,178 @@
+package backup
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sign-pkcs11/hsm"
+
+	"github.com/miekg/pkcs11"
+)
+
+// RestoredKey describes a key pair recreated from a bundle
+type RestoredKey struct {
+	PrivateKeyLabel  string              `json:"private_key_label"`
+	PublicKeyLabel   string              `json:"public_key_label,omitempty"`
+	PrivateKeyHandle pkcs11.ObjectHandle `json:"private_key_handle"`
+	PublicKeyHandle  pkcs11.ObjectHandle `json:"public_key_handle,omitempty"`
+	KeyID            string              `json:"key_id"`
+}
+
+// Restore unwraps every key in the bundle with the slot's wrapping key and
+// recreates the public key objects. The wrapping key on the target slot must
+// hold the same value as the one the bundle was produced with.
+func Restore(provider string, slotID int, userPin string, wrapKeyLabel string, bundle *Bundle) ([]RestoredKey, error) {
+	if bundle == nil || bundle.Version != BundleVersion {
+		return nil, fmt.Errorf("unsupported backup bundle version")
+	}
+	if bundle.Mechanism != wrapMechanism {
+		return nil, fmt.Errorf("unsupported wrapping mechanism: %s", bundle.Mechanism)
+	}
+	if wrapKeyLabel == "" {
+		wrapKeyLabel = bundle.WrapKeyLabel
+	}
+
+	if err := hsm.CheckMechanism(provider, slotID, pkcs11.CKM_AES_KEY_WRAP_PAD, pkcs11.CKF_UNWRAP, 0); err != nil {
+		return nil, err
+	}
+
+	s, err := hsm.Open(provider, slotID, userPin)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	kek, err := wrappingKey(s, WrapKeyOptions{Label: wrapKeyLabel})
+	if err != nil {
+		return nil, err
+	}
+
+	restored := []RestoredKey{}
+	for _, key := range bundle.Keys {
+		result, err := restoreKey(s, kek, key)
+		if err != nil {
+			return restored, fmt.Errorf("%s: %w", key.PrivateKeyLabel, err)
+		}
+		restored = append(restored, *result)
+	}
+	return restored, nil
+}
+
+// restoreKey unwraps one private key and creates its public key object
+func restoreKey(s *hsm.Session, kek pkcs11.ObjectHandle, key BundleKey) (*RestoredKey, error) {
+	var keyType uint
+	found := false
+	for typ, name := range hsm.KeyTypeNames {
+		if name == key.KeyType {
+			keyType, found = typ, true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("unsupported key type: %s", key.KeyType)
+	}
+
+	keyID, err := hex.DecodeString(key.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key ID: %w", err)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(key.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+
+	existing, err := s.FindObjects([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, key.PrivateKeyLabel),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return nil, fmt.Errorf("a private key with this label already exists on the slot")
+	}
+	// The public key is checked before the private key is unwrapped, so
+	// that a bad entry leaves nothing behind
+	pubTemplate, err := publicTemplate(key, keyID, keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, key.PrivateKeyLabel),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, keyID),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+	}
+	if key.ECParams != "" {
+		params, err := hex.DecodeString(key.ECParams)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC parameters: %w", err)
+		}
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params))
+	}
+	for name, typ := range copiedAttributes {
+		if value, ok := key.Attributes[name]; ok {
+			template = append(template, pkcs11.NewAttribute(typ, value))
+		}
+	}
+
+	priv, err := s.Ctx.UnwrapKey(s.Handle, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP_PAD, nil)}, kek, wrapped, template)
+	if err != nil {
+		return nil, fmt.Errorf("UnwrapKey failed: %w", err)
+	}
+	result := &RestoredKey{
+		PrivateKeyLabel:  key.PrivateKeyLabel,
+		PrivateKeyHandle: priv,
+		KeyID:            key.KeyID,
+	}
+
+	if pubTemplate == nil {
+		return result, nil
+	}
+	pubHandle, err := s.Ctx.CreateObject(s.Handle, pubTemplate)
+	if err != nil {
+		s.Ctx.DestroyObject(s.Handle, priv)
+		return nil, fmt.Errorf("failed to create public key object: %w", err)
+	}
+	result.PublicKeyLabel = key.PublicKeyLabel
+	result.PublicKeyHandle = pubHandle
+	return result, nil
+}
+
+// publicTemplate returns the template of the entry's public key object, or
+// nil when the entry has no public key
+func publicTemplate(key BundleKey, keyID []byte, keyType uint) ([]*pkcs11.Attribute, error) {
+	if key.PublicKeyLabel == "" || key.PublicKey == "" {
+		return nil, nil
+	}
+	der, err := base64.StdEncoding.DecodeString(key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	pubAttrs, err := hsm.PublicKeyAttributes(pub)
+	if err != nil {
+		return nil, err
+	}
+	template := append([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, key.PublicKeyLabel),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, keyID),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, key.Attributes["sign"]),
+	}, pubAttrs...)
+	if keyType == pkcs11.CKK_RSA {
+		template = append(template,
+			pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, key.Attributes["decrypt"]),
+			pkcs11.NewAttribute(pkcs11.CKA_WRAP, key.Attributes["unwrap"]),
+		)
+	}
+	return template, nil
+}
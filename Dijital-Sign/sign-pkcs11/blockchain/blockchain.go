@@ -1,10 +1,13 @@
 package blockchain
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger/v3"
@@ -18,11 +21,16 @@ type Block struct {
 	Signature    string
 	PreviousHash string
 	Hash         string
+	KeyLabel     string // İmzada kullanılan anahtarın label'ı (opsiyonel)
+	Nonce        string // Blok eklenirken üretilen hex nonce; hash'e dahildir
 }
 
-// Blok hash hesaplama fonksiyonu
+// Blok hash hesaplama fonksiyonu. Hash; Index, Timestamp, Data, Signature,
+// PreviousHash, KeyLabel ve Nonce alanlarını kapsar, yani nonce değiştirilirse
+// blok doğrulanamaz.
 func (b *Block) calculateHash() string {
-	record := string(b.Index) + b.Timestamp + b.Data + b.Signature + b.PreviousHash
+	// KeyLabel ve Nonce boşken eski blokların hash'i değişmez
+	record := string(b.Index) + b.Timestamp + b.Data + b.Signature + b.PreviousHash + b.KeyLabel + b.Nonce
 	hash := sha256.Sum256([]byte(record))
 	return fmt.Sprintf("%x", hash)
 }
@@ -40,8 +48,12 @@ func NewBlock(data, signature, previousHash string, index int) *Block {
 	return block
 }
 
+// nonceLength yeni bloklara eklenen nonce'un bayt uzunluğu
+const nonceLength = 16
+
 // Blockchain yapısı
 type Blockchain struct {
+	mu     sync.RWMutex
 	db     *badger.DB
 	blocks []*Block
 }
@@ -68,12 +80,83 @@ func NewBlockchain() *Blockchain {
 
 // Yeni blok ekleme fonksiyonu
 func (bc *Blockchain) AddBlock(data, signature string) {
+	bc.AddKeyBlock(data, signature, "")
+}
+
+// Anahtar label'ı ile ilişkilendirilmiş yeni blok ekleme fonksiyonu
+func (bc *Blockchain) AddKeyBlock(data, signature, keyLabel string) {
+	// Her yeni blok nonce taşır. Nonce işletim sisteminin CSPRNG'sinden alınır,
+	// böylece defter yazımı HSM'e bağlı kalmaz; üretilemezse blok yazılmaz.
+	random := make([]byte, nonceLength)
+	if _, err := rand.Read(random); err != nil {
+		log.Fatalf("Blok nonce'u üretilemedi: %v", err)
+	}
+	nonce := fmt.Sprintf("%x", random)
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
 	previousBlock := bc.blocks[len(bc.blocks)-1]
-	newBlock := NewBlock(data, signature, previousBlock.Hash, len(bc.blocks))
+	newBlock := &Block{
+		Index:        len(bc.blocks),
+		Timestamp:    time.Now().String(),
+		Data:         data,
+		Signature:    signature,
+		PreviousHash: previousBlock.Hash,
+		KeyLabel:     keyLabel,
+		Nonce:        nonce,
+	}
+	newBlock.Hash = newBlock.calculateHash()
 	bc.saveBlock(newBlock)
 	bc.blocks = append(bc.blocks, newBlock)
 }
 
+// Verilen label'lardan birine referans veren blokları döndürür. KeyLabel
+// alanı olmayan eski bloklar ve AddBlock ile yazılan olaylar için Data da
+// taranır: label, Data içinde label karakterlerinden (harf, rakam, '_', '-',
+// '.') biriyle bitişik olmayan bütün bir kelime olarak geçiyorsa blok
+// referans sayılır.
+func (bc *Blockchain) KeyReferences(labels ...string) []*Block {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	var refs []*Block
+	for _, block := range bc.blocks {
+		for _, label := range labels {
+			if label == "" {
+				continue
+			}
+			if block.KeyLabel == label || containsLabel(block.Data, label) {
+				refs = append(refs, block)
+				break
+			}
+		}
+	}
+	return refs
+}
+
+// containsLabel label'ın data içinde bütün bir kelime olarak geçip
+// geçmediğini döndürür
+func containsLabel(data, label string) bool {
+	for i := 0; ; {
+		j := strings.Index(data[i:], label)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(label)
+		if (start == 0 || !isLabelByte(data[start-1])) && (end == len(data) || !isLabelByte(data[end])) {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+// isLabelByte anahtar label'larında kelimeyi sürdüren karakterleri tanır
+func isLabelByte(c byte) bool {
+	return c == '_' || c == '-' || c == '.' ||
+		('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
 // Blokları kaydetme fonksiyonu
 func (bc *Blockchain) saveBlock(block *Block) {
 	err := bc.db.Update(func(txn *badger.Txn) error {
@@ -124,7 +207,10 @@ func (bc *Blockchain) loadBlocks() {
 
 // Blockchain'deki tüm blokları listeleme fonksiyonu
 func (bc *Blockchain) ListData() []*Block {
-	return bc.blocks
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	return append([]*Block(nil), bc.blocks...)
 }
 
 // Blockchain'i kapatma fonksiyonu
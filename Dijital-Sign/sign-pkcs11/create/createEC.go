@@ -0,0 +1,126 @@
+package create
+
+import (
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sign-pkcs11/hsm"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ECKeyPairResponse represents the structure for the EC key pair response
+type ECKeyPairResponse struct {
+	PublicKeyLabel   string              `json:"public_key_label"`
+	PrivateKeyLabel  string              `json:"private_key_label"`
+	PublicKeyHandle  pkcs11.ObjectHandle `json:"public_key_handle"`
+	PrivateKeyHandle pkcs11.ObjectHandle `json:"private_key_handle"`
+	KeyID            string              `json:"key_id"`
+	Profile          string              `json:"profile"`
+	Curve            string              `json:"curve"`
+	PublicPoint      string              `json:"public_point"`
+}
+
+// curveBits is the field size of each supported curve, the unit tokens use
+// for EC key sizes in C_GetMechanismInfo
+var curveBits = map[string]uint{
+	"P-256": 256,
+	"P-384": 384,
+	"P-521": 521,
+}
+
+// ecParams returns the DER encoded CKA_EC_PARAMS value for the given curve name
+func ecParams(curve string) ([]byte, error) {
+	oid, ok := hsm.CurveOIDs[curve]
+	if !ok || curve == "Ed25519" {
+		return nil, fmt.Errorf("%w: unsupported EC curve: %s (supported: P-256, P-384, P-521)", hsm.ErrInvalidRequest, curve)
+	}
+	return asn1.Marshal(oid)
+}
+
+// GenerateECKey generates an EC key pair on the HSM and returns the details in JSON format
+func GenerateECKey(provider string, slotID int, userPin string, curve string, keyLabel string, requestedKeyID string, profileName string) (string, error) {
+	profile, err := lookupSigningProfile(profileName)
+	if err != nil {
+		return "", err
+	}
+
+	params, err := ecParams(curve)
+	if err != nil {
+		return "", err
+	}
+	if err := hsm.CheckMechanism(provider, slotID, pkcs11.CKM_EC_KEY_PAIR_GEN, pkcs11.CKF_GENERATE_KEY_PAIR, curveBits[curve]); err != nil {
+		return "", err
+	}
+
+	p, session, closeSession, err := openSession(provider, slotID, userPin)
+	if err != nil {
+		return "", err
+	}
+	defer closeSession()
+
+	// Define key attributes
+	keyID, err := newKeyID(p, session, requestedKeyID)
+	if err != nil {
+		return "", err
+	}
+
+	publicKeyTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel+"_pub"),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, keyID),
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+	}
+	publicKeyTemplate = append(publicKeyTemplate, profile.publicAttributes(pkcs11.CKK_EC)...)
+
+	privateKeyTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel+"_priv"),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, keyID),
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+	}
+	privateKeyTemplate = append(privateKeyTemplate, profile.privateAttributes(pkcs11.CKK_EC)...)
+
+	// Generate the EC key pair
+	pubKeyHandle, privKeyHandle, err := p.GenerateKeyPair(
+		session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)},
+		publicKeyTemplate,
+		privateKeyTemplate,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate EC key pair: %w", err)
+	}
+
+	// Read back the public point (DER encoded OCTET STRING)
+	attrs, err := p.GetAttributeValue(session, pubKeyHandle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read EC public point: %w", err)
+	}
+
+	// Create the response struct
+	response := ECKeyPairResponse{
+		PublicKeyLabel:   keyLabel + "_pub",
+		PrivateKeyLabel:  keyLabel + "_priv",
+		PublicKeyHandle:  pubKeyHandle,
+		PrivateKeyHandle: privKeyHandle,
+		KeyID:            hex.EncodeToString(keyID),
+		Profile:          profile.Name,
+		Curve:            curve,
+		PublicPoint:      hex.EncodeToString(attrs[0].Value),
+	}
+
+	// Convert the response to JSON format
+	jsonResponse, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to generate JSON response: %w", err)
+	}
+
+	return string(jsonResponse), nil
+}
@@ -0,0 +1,97 @@
+package create
+
+import (
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sign-pkcs11/hsm"
+
+	"github.com/miekg/pkcs11"
+)
+
+// GenerateEd25519Key generates an Ed25519 key pair on the HSM and returns the details in JSON format
+func GenerateEd25519Key(provider string, slotID int, userPin string, keyLabel string, requestedKeyID string, profileName string) (string, error) {
+	profile, err := lookupSigningProfile(profileName)
+	if err != nil {
+		return "", err
+	}
+
+	params, err := asn1.Marshal(hsm.CurveOIDs["Ed25519"])
+	if err != nil {
+		return "", fmt.Errorf("failed to encode Ed25519 parameters: %w", err)
+	}
+	if err := hsm.CheckMechanism(provider, slotID, hsm.CKM_EC_EDWARDS_KEY_PAIR_GEN, pkcs11.CKF_GENERATE_KEY_PAIR, 0); err != nil {
+		return "", err
+	}
+
+	p, session, closeSession, err := openSession(provider, slotID, userPin)
+	if err != nil {
+		return "", err
+	}
+	defer closeSession()
+
+	// Define key attributes
+	keyID, err := newKeyID(p, session, requestedKeyID)
+	if err != nil {
+		return "", err
+	}
+
+	publicKeyTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel+"_pub"),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, keyID),
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, hsm.CKK_EC_EDWARDS),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+	}
+	publicKeyTemplate = append(publicKeyTemplate, profile.publicAttributes(hsm.CKK_EC_EDWARDS)...)
+
+	privateKeyTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel+"_priv"),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, keyID),
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, hsm.CKK_EC_EDWARDS),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+	}
+	privateKeyTemplate = append(privateKeyTemplate, profile.privateAttributes(hsm.CKK_EC_EDWARDS)...)
+
+	// Generate the Ed25519 key pair
+	pubKeyHandle, privKeyHandle, err := p.GenerateKeyPair(
+		session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(hsm.CKM_EC_EDWARDS_KEY_PAIR_GEN, nil)},
+		publicKeyTemplate,
+		privateKeyTemplate,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate Ed25519 key pair: %w", err)
+	}
+
+	// Read back the public point (DER encoded OCTET STRING)
+	attrs, err := p.GetAttributeValue(session, pubKeyHandle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read Ed25519 public point: %w", err)
+	}
+
+	// Create the response struct
+	response := ECKeyPairResponse{
+		PublicKeyLabel:   keyLabel + "_pub",
+		PrivateKeyLabel:  keyLabel + "_priv",
+		PublicKeyHandle:  pubKeyHandle,
+		PrivateKeyHandle: privKeyHandle,
+		KeyID:            hex.EncodeToString(keyID),
+		Profile:          profile.Name,
+		Curve:            "Ed25519",
+		PublicPoint:      hex.EncodeToString(attrs[0].Value),
+	}
+
+	// Convert the response to JSON format
+	jsonResponse, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to generate JSON response: %w", err)
+	}
+
+	return string(jsonResponse), nil
+}
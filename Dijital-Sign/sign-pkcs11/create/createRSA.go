@@ -1,9 +1,10 @@
 package create
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"os"
+	"sign-pkcs11/hsm"
 
 	"github.com/miekg/pkcs11"
 )
@@ -14,39 +15,35 @@ type KeyPairResponse struct {
 	PrivateKeyLabel  string              `json:"private_key_label"`
 	PublicKeyHandle  pkcs11.ObjectHandle `json:"public_key_handle"`
 	PrivateKeyHandle pkcs11.ObjectHandle `json:"private_key_handle"`
+	KeyID            string              `json:"key_id"`
+	Profile          string              `json:"profile"`
 }
 
 // GenerateRSAKey generates an RSA key pair on the HSM and returns the details in JSON format
-func GenerateRSAKey(slotID int, userPin string, keySize int, keyLabel string) (string, error) {
-	// Get the PKCS#11 library path from the environment
-	libraryPath := os.Getenv("PKCS11_LIB")
-	if libraryPath == "" {
-		return "", fmt.Errorf("PKCS11_LIB environment variable is not set")
+func GenerateRSAKey(provider string, slotID int, userPin string, keySize int, keyLabel string, requestedKeyID string, profileName string) (string, error) {
+	profile, err := lookupProfile(profileName)
+	if err != nil {
+		return "", err
 	}
-
-	// Initialize PKCS#11 library
-	p := pkcs11.New(libraryPath)
-	if err := p.Initialize(); err != nil {
-		return "", fmt.Errorf("failed to initialize PKCS#11 library: %v", err)
+	if keySize <= 0 {
+		return "", fmt.Errorf("%w: invalid RSA key size: %d", hsm.ErrInvalidRequest, keySize)
 	}
-	defer p.Finalize()
-
-	// Open a session for the given slot ID
-	session, err := p.OpenSession(uint(slotID), pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
-	if err != nil {
-		return "", fmt.Errorf("failed to open session: %v", err)
+	if err := hsm.CheckMechanism(provider, slotID, pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, pkcs11.CKF_GENERATE_KEY_PAIR, uint(keySize)); err != nil {
+		return "", err
 	}
-	defer p.CloseSession(session)
 
-	// Log in to the session using the user PIN
-	if err := p.Login(session, pkcs11.CKU_USER, userPin); err != nil {
-		return "", fmt.Errorf("failed to log in: %v", err)
+	p, session, closeSession, err := openSession(provider, slotID, userPin)
+	if err != nil {
+		return "", err
 	}
-	defer p.Logout(session)
+	defer closeSession()
 
 	// Define key attributes
 	modulusBits := keySize
-	keyID := []byte{1, 2, 3, 4}
+	keyID, err := newKeyID(p, session, requestedKeyID)
+	if err != nil {
+		return "", err
+	}
 
 	publicKeyTemplate := []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel+"_pub"),
@@ -54,24 +51,18 @@ func GenerateRSAKey(slotID int, userPin string, keySize int, keyLabel string) (s
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
 		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
 		pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, modulusBits),
-		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
-		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
-		pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
 		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
 	}
+	publicKeyTemplate = append(publicKeyTemplate, profile.publicAttributes(pkcs11.CKK_RSA)...)
 
 	privateKeyTemplate := []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel+"_priv"),
 		pkcs11.NewAttribute(pkcs11.CKA_ID, keyID),
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
 		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
-		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
-		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
-		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
 		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
-		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
-    	pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
 	}
+	privateKeyTemplate = append(privateKeyTemplate, profile.privateAttributes(pkcs11.CKK_RSA)...)
 
 	// Generate the RSA key pair
 	pubKeyHandle, privKeyHandle, err := p.GenerateKeyPair(
@@ -81,7 +72,7 @@ func GenerateRSAKey(slotID int, userPin string, keySize int, keyLabel string) (s
 		privateKeyTemplate,
 	)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate RSA key pair: %v", err)
+		return "", fmt.Errorf("failed to generate RSA key pair: %w", err)
 	}
 
 	// Create the response struct
@@ -90,12 +81,14 @@ func GenerateRSAKey(slotID int, userPin string, keySize int, keyLabel string) (s
 		PrivateKeyLabel:  keyLabel + "_priv",
 		PublicKeyHandle:  pubKeyHandle,
 		PrivateKeyHandle: privKeyHandle,
+		KeyID:            hex.EncodeToString(keyID),
+		Profile:          profile.Name,
 	}
 
 	// Convert the response to JSON format
 	jsonResponse, err := json.MarshalIndent(response, "", "  ")
 	if err != nil {
-		return "", fmt.Errorf("failed to generate JSON response: %v", err)
+		return "", fmt.Errorf("failed to generate JSON response: %w", err)
 	}
 
 	return string(jsonResponse), nil
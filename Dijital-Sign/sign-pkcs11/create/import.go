@@ -0,0 +1,324 @@
+package create
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sign-pkcs11/hsm"
+
+	"github.com/miekg/pkcs11"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Import formats accepted by ImportKey
+const (
+	ImportPKCS8  = "pkcs8"
+	ImportPKCS12 = "pkcs12"
+)
+
+// ImportResponse represents the structure for the key import response
+type ImportResponse struct {
+	PublicKeyLabel    string              `json:"public_key_label"`
+	PrivateKeyLabel   string              `json:"private_key_label"`
+	PublicKeyHandle   pkcs11.ObjectHandle `json:"public_key_handle"`
+	PrivateKeyHandle  pkcs11.ObjectHandle `json:"private_key_handle"`
+	KeyID             string              `json:"key_id"`
+	Profile           string              `json:"profile"`
+	KeyType           string              `json:"key_type"`
+	CertificateLabels []string            `json:"certificate_labels"`
+}
+
+// ImportKey parses a private key (and any certificates) from a PKCS#8 PEM
+// bundle or a base64 encoded PKCS#12 file and stores them on the token as
+// <label>_priv, <label>_pub and <label>_cert / <label>_chain<N> objects
+// sharing one CKA_ID
+func ImportKey(provider string, slotID int, userPin string, format string, data string, password string, keyLabel string, requestedKeyID string, profileName string) (string, error) {
+	var (
+		key   crypto.Signer
+		certs []*x509.Certificate
+		err   error
+	)
+	switch format {
+	case ImportPKCS8:
+		key, certs, err = parseKeyAndCerts(decodePEMBlocks([]byte(data)))
+	case ImportPKCS12:
+		key, certs, err = decodePKCS12(data, password)
+	default:
+		err = fmt.Errorf("%w: unsupported import format: %s (supported: pkcs8, pkcs12)", hsm.ErrInvalidRequest, format)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var profile KeyProfile
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		profile, err = lookupProfile(profileName)
+	} else {
+		profile, err = lookupSigningProfile(profileName)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Put the certificate matching the private key first
+	certs = orderChain(key, certs)
+
+	p, session, closeSession, err := openSession(provider, slotID, userPin)
+	if err != nil {
+		return "", err
+	}
+	defer closeSession()
+
+	keyID, err := newKeyID(p, session, requestedKeyID)
+	if err != nil {
+		return "", err
+	}
+
+	common := func(class uint) []*pkcs11.Attribute {
+		label := keyLabel + "_pub"
+		if class == pkcs11.CKO_PRIVATE_KEY {
+			label = keyLabel + "_priv"
+		}
+		return []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, keyID),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		}
+	}
+
+	publicAttrs, err := hsm.PublicKeyAttributes(key.Public())
+	if err != nil {
+		return "", err
+	}
+	publicKeyTemplate := append(common(pkcs11.CKO_PUBLIC_KEY), publicAttrs...)
+	privateKeyTemplate := append(common(pkcs11.CKO_PRIVATE_KEY), pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true))
+	var keyType string
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		keyType = "RSA"
+		k.Precompute()
+		privateKeyTemplate = append(privateKeyTemplate,
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, k.N.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, big.NewInt(int64(k.E)).Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE_EXPONENT, k.D.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIME_1, k.Primes[0].Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIME_2, k.Primes[1].Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_1, k.Precomputed.Dp.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_2, k.Precomputed.Dq.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_COEFFICIENT, k.Precomputed.Qinv.Bytes()),
+		)
+		publicKeyTemplate = append(publicKeyTemplate, profile.publicAttributes(pkcs11.CKK_RSA)...)
+		privateKeyTemplate = append(privateKeyTemplate, profile.privateAttributes(pkcs11.CKK_RSA)...)
+
+	case *ecdsa.PrivateKey:
+		curve := k.Curve.Params().Name
+		keyType = "EC " + curve
+		params, err := ecParams(curve)
+		if err != nil {
+			return "", err
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		privateKeyTemplate = append(privateKeyTemplate,
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, k.D.FillBytes(make([]byte, size))),
+		)
+		publicKeyTemplate = append(publicKeyTemplate, profile.publicAttributes(pkcs11.CKK_EC)...)
+		privateKeyTemplate = append(privateKeyTemplate, profile.privateAttributes(pkcs11.CKK_EC)...)
+
+	case ed25519.PrivateKey:
+		keyType = "Ed25519"
+		params, err := asn1.Marshal(hsm.CurveOIDs["Ed25519"])
+		if err != nil {
+			return "", fmt.Errorf("failed to encode Ed25519 parameters: %w", err)
+		}
+		privateKeyTemplate = append(privateKeyTemplate,
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, hsm.CKK_EC_EDWARDS),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, k.Seed()),
+		)
+		publicKeyTemplate = append(publicKeyTemplate, profile.publicAttributes(hsm.CKK_EC_EDWARDS)...)
+		privateKeyTemplate = append(privateKeyTemplate, profile.privateAttributes(hsm.CKK_EC_EDWARDS)...)
+
+	default:
+		return "", fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	// Objects created so far are destroyed if a later step fails, so a
+	// failed import leaves nothing behind on the token
+	var created []pkcs11.ObjectHandle
+	rollback := func() {
+		for _, handle := range created {
+			p.DestroyObject(session, handle)
+		}
+	}
+
+	privKeyHandle, err := p.CreateObject(session, privateKeyTemplate)
+	if err != nil {
+		return "", fmt.Errorf("failed to create private key object: %w", err)
+	}
+	created = append(created, privKeyHandle)
+	pubKeyHandle, err := p.CreateObject(session, publicKeyTemplate)
+	if err != nil {
+		rollback()
+		return "", fmt.Errorf("failed to create public key object: %w", err)
+	}
+	created = append(created, pubKeyHandle)
+
+	certLabels := []string{}
+	s := &hsm.Session{Ctx: p, Handle: session, SlotID: slotID, Provider: provider}
+	for i, cert := range certs {
+		label, id := fmt.Sprintf("%s_chain%d", keyLabel, i), cert.SubjectKeyId
+		if i == 0 && publicKeysEqual(key, cert.PublicKey) {
+			label, id = keyLabel+"_cert", keyID
+		}
+		handle, err := s.StoreCertificate(cert, label, id)
+		if err != nil {
+			rollback()
+			return "", err
+		}
+		created = append(created, handle)
+		certLabels = append(certLabels, label)
+	}
+
+	// Create the response struct
+	response := ImportResponse{
+		PublicKeyLabel:    keyLabel + "_pub",
+		PrivateKeyLabel:   keyLabel + "_priv",
+		PublicKeyHandle:   pubKeyHandle,
+		PrivateKeyHandle:  privKeyHandle,
+		KeyID:             hex.EncodeToString(keyID),
+		Profile:           profile.Name,
+		KeyType:           keyType,
+		CertificateLabels: certLabels,
+	}
+
+	// Convert the response to JSON format
+	jsonResponse, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		rollback()
+		return "", fmt.Errorf("failed to generate JSON response: %w", err)
+	}
+
+	return string(jsonResponse), nil
+}
+
+// decodePEMBlocks returns every PEM block in data
+func decodePEMBlocks(data []byte) []*pem.Block {
+	var blocks []*pem.Block
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return blocks
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+// decodePKCS12 decodes a base64 encoded PKCS#12 file. Both the legacy
+// 3DES/RC2 encryption and the PBES2/AES-256 default of OpenSSL 3 are read.
+func decodePKCS12(data string, password string) (crypto.Signer, []*x509.Certificate, error) {
+	pfx, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: PKCS#12 data must be base64 encoded: %w", hsm.ErrInvalidRequest, err)
+	}
+	privateKey, cert, chain, err := pkcs12.DecodeChain(pfx, password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: failed to decode PKCS#12 data: %w", hsm.ErrInvalidRequest, err)
+	}
+	key, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: unsupported private key type %T", hsm.ErrInvalidRequest, privateKey)
+	}
+	return key, append([]*x509.Certificate{cert}, chain...), nil
+}
+
+// parseKeyAndCerts picks the single private key and all certificates out of
+// the PEM blocks. Besides PKCS#8, PKCS#1 and SEC 1 encodings are accepted.
+func parseKeyAndCerts(blocks []*pem.Block) (crypto.Signer, []*x509.Certificate, error) {
+	var (
+		key   crypto.Signer
+		certs []*x509.Certificate
+	)
+	for _, block := range blocks {
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%w: failed to parse certificate: %w", hsm.ErrInvalidRequest, err)
+			}
+			certs = append(certs, cert)
+		case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY":
+			if key != nil {
+				return nil, nil, fmt.Errorf("%w: more than one private key found", hsm.ErrInvalidRequest)
+			}
+			parsed, err := parsePrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			key = parsed
+		case "ENCRYPTED PRIVATE KEY":
+			return nil, nil, fmt.Errorf("%w: encrypted PKCS#8 keys are not supported, decrypt the key or use PKCS#12", hsm.ErrInvalidRequest)
+		}
+	}
+	if key == nil {
+		return nil, nil, fmt.Errorf("%w: no private key found", hsm.ErrInvalidRequest)
+	}
+	return key, certs, nil
+}
+
+// parsePrivateKey tries PKCS#8, PKCS#1 and SEC 1 in turn
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%w: unsupported private key type %T", hsm.ErrInvalidRequest, key)
+		}
+		return signer, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: failed to parse private key: not PKCS#8, PKCS#1 or SEC 1", hsm.ErrInvalidRequest)
+}
+
+// orderChain moves the certificate for the private key to the front
+func orderChain(key crypto.Signer, certs []*x509.Certificate) []*x509.Certificate {
+	for i, cert := range certs {
+		if publicKeysEqual(key, cert.PublicKey) {
+			ordered := append([]*x509.Certificate{cert}, certs[:i]...)
+			return append(ordered, certs[i+1:]...)
+		}
+	}
+	return certs
+}
+
+// publicKeysEqual reports whether pub is the public half of key
+func publicKeysEqual(key crypto.Signer, pub crypto.PublicKey) bool {
+	a, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return false
+	}
+	b, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(a, b)
+}
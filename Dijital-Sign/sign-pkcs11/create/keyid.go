@@ -0,0 +1,44 @@
+package create
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sign-pkcs11/hsm"
+
+	"github.com/miekg/pkcs11"
+)
+
+// keyIDLength is the number of random bytes used for generated CKA_ID values
+const keyIDLength = 16
+
+// newKeyID returns the CKA_ID to assign to a new key pair. A caller supplied
+// hex ID is used as is after checking that no object on the token already
+// carries it; otherwise a fresh ID is drawn from the token's RNG.
+func newKeyID(p *pkcs11.Ctx, session pkcs11.SessionHandle, requestedID string) ([]byte, error) {
+	if requestedID == "" {
+		keyID, err := hsm.GenerateRandom(p, session, keyIDLength)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate key ID: %w", err)
+		}
+		return keyID, nil
+	}
+
+	keyID, err := hex.DecodeString(requestedID)
+	if err != nil || len(keyID) == 0 {
+		return nil, fmt.Errorf("%w: invalid key ID %q: must be a non-empty hex string", hsm.ErrInvalidRequest, requestedID)
+	}
+
+	if err := p.FindObjectsInit(session, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, keyID)}); err != nil {
+		return nil, fmt.Errorf("failed to search for key ID: %w", err)
+	}
+	objs, _, err := p.FindObjects(session, 1)
+	p.FindObjectsFinal(session)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for key ID: %w", err)
+	}
+	if len(objs) > 0 {
+		return nil, fmt.Errorf("key ID %s is already in use on this token", requestedID)
+	}
+
+	return keyID, nil
+}
@@ -0,0 +1,117 @@
+package create
+
+import (
+	"fmt"
+	"sign-pkcs11/hsm"
+	"sort"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+// DefaultKeyProfile is applied when the caller does not select a profile
+const DefaultKeyProfile = "signing-only"
+
+// KeyProfile describes the usage and protection attributes applied to a
+// generated key pair
+type KeyProfile struct {
+	Name        string
+	Sign        bool // CKA_SIGN on the private key, CKA_VERIFY on the public key
+	Encrypt     bool // CKA_DECRYPT on the private key, CKA_ENCRYPT on the public key
+	Wrap        bool // CKA_UNWRAP on the private key, CKA_WRAP on the public key
+	Sensitive   bool
+	Extractable bool
+}
+
+// keyProfiles holds the named profiles selectable by callers
+var keyProfiles = map[string]KeyProfile{
+	"signing-only": {
+		Name:        "signing-only",
+		Sign:        true,
+		Sensitive:   true,
+		Extractable: false,
+	},
+	"encryption-only": {
+		Name:        "encryption-only",
+		Encrypt:     true,
+		Wrap:        true,
+		Sensitive:   true,
+		Extractable: false,
+	},
+	// Private key may only leave the token wrapped under another key
+	"exportable-backup": {
+		Name:        "exportable-backup",
+		Sign:        true,
+		Encrypt:     true,
+		Sensitive:   true,
+		Extractable: true,
+	},
+}
+
+// lookupProfile returns the named profile, or the default one for an empty name
+func lookupProfile(name string) (KeyProfile, error) {
+	if name == "" {
+		name = DefaultKeyProfile
+	}
+	profile, ok := keyProfiles[name]
+	if !ok {
+		names := make([]string, 0, len(keyProfiles))
+		for n := range keyProfiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return KeyProfile{}, fmt.Errorf("%w: unknown key profile: %s (supported: %s)", hsm.ErrInvalidRequest, name, strings.Join(names, ", "))
+	}
+	return profile, nil
+}
+
+// lookupSigningProfile returns the named profile for key types that can only
+// sign (EC, Ed25519), rejecting profiles that do not allow signing
+func lookupSigningProfile(name string) (KeyProfile, error) {
+	profile, err := lookupProfile(name)
+	if err != nil {
+		return KeyProfile{}, err
+	}
+	if !profile.Sign {
+		return KeyProfile{}, fmt.Errorf("%w: key profile %s is not supported for signing-only key types", hsm.ErrInvalidRequest, profile.Name)
+	}
+	return profile, nil
+}
+
+// SigningProfile returns the named profile, or the default one for an empty
+// name, and rejects profiles that do not allow signing
+func SigningProfile(name string) (KeyProfile, error) {
+	return lookupSigningProfile(name)
+}
+
+// publicAttributes returns the usage attributes for the public key template.
+// Encryption and wrapping flags are only emitted for RSA keys.
+func (kp KeyProfile) publicAttributes(keyType uint) []*pkcs11.Attribute {
+	attrs := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, kp.Sign),
+	}
+	if keyType == pkcs11.CKK_RSA {
+		attrs = append(attrs,
+			pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, kp.Encrypt),
+			pkcs11.NewAttribute(pkcs11.CKA_WRAP, kp.Wrap),
+		)
+	}
+	return attrs
+}
+
+// privateAttributes returns the usage and protection attributes for the
+// private key template. Encryption and wrapping flags are only emitted for RSA keys.
+func (kp KeyProfile) privateAttributes(keyType uint) []*pkcs11.Attribute {
+	attrs := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, kp.Sign),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, kp.Sensitive),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, kp.Extractable),
+	}
+	if keyType == pkcs11.CKK_RSA {
+		attrs = append(attrs,
+			pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, kp.Encrypt),
+			pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, kp.Wrap),
+		)
+	}
+	return attrs
+}
@@ -0,0 +1,18 @@
+package create
+
+import (
+	"sign-pkcs11/hsm"
+
+	"github.com/miekg/pkcs11"
+)
+
+// openSession borrows a logged-in read/write session on the given slot from
+// the shared session pool. The returned function gives the session back and
+// must be deferred by the caller.
+func openSession(provider string, slotID int, userPin string) (*pkcs11.Ctx, pkcs11.SessionHandle, func(), error) {
+	s, err := hsm.Open(provider, slotID, userPin)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return s.Ctx, s.Handle, s.Close, nil
+}
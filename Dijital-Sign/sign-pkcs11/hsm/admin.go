@@ -0,0 +1,106 @@
+package hsm
+
+import (
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// SetPIN changes the user PIN of a slot with C_SetPIN on a pooled session.
+// The pool checks later borrowers against the new PIN.
+func SetPIN(provider string, slotID int, oldPin string, newPin string) error {
+	m, err := Lookup(provider)
+	if err != nil {
+		return err
+	}
+	s, err := m.Open(slotID, oldPin)
+	if err != nil {
+		return err
+	}
+	err = s.Ctx.SetPIN(s.Handle, oldPin, newPin)
+	s.Close()
+	if err != nil {
+		return fmt.Errorf("SetPIN failed: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, ok := m.pools[uint(slotID)]; ok {
+		p.pin = newPin
+	}
+	return nil
+}
+
+// InitPIN sets the user PIN of a slot with C_InitPIN in a security officer
+// session. The slot's pool is closed first, since a token allows only one
+// user type to be logged in; the next Open logs in with the new PIN.
+func InitPIN(provider string, slotID int, soPin string, newPin string) error {
+	m, err := Lookup(provider)
+	if err != nil {
+		return err
+	}
+	return m.withSO(uint(slotID), soPin, func(session pkcs11.SessionHandle) error {
+		if err := m.ctx.InitPIN(session, newPin); err != nil {
+			return fmt.Errorf("InitPIN failed: %w", err)
+		}
+		return nil
+	})
+}
+
+// InitToken erases the token in a slot with C_InitToken and gives it a new
+// label. C_InitToken fails while sessions are open, so the slot's pool is
+// closed first.
+func InitToken(provider string, slotID int, soPin string, label string) error {
+	m, err := Lookup(provider)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrManagerClosed
+	}
+	m.closePool(uint(slotID))
+	if err := m.ctx.InitToken(uint(slotID), soPin, label); err != nil {
+		return fmt.Errorf("InitToken failed: %w", err)
+	}
+
+	m.mechMu.Lock()
+	delete(m.mechCache, uint(slotID))
+	m.mechMu.Unlock()
+	return nil
+}
+
+// withSO closes the slot's pool and runs fn in a fresh session logged in as
+// security officer. m.mu is held throughout so no pool is created meanwhile.
+func (m *Manager) withSO(slotID uint, soPin string, fn func(session pkcs11.SessionHandle) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrManagerClosed
+	}
+	m.closePool(slotID)
+
+	session, err := m.ctx.OpenSession(slotID, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return fmt.Errorf("failed to open session: %w", err)
+	}
+	defer m.ctx.CloseSession(session)
+	if err := m.ctx.Login(session, pkcs11.CKU_SO, soPin); err != nil {
+		return fmt.Errorf("failed to log in as security officer: %w", err)
+	}
+	defer m.ctx.Logout(session)
+	return fn(session)
+}
+
+// closePool logs out of a slot and closes its sessions. Callers whose
+// sessions fail because of this see a new generation and open a session
+// again instead of reconnecting. m.mu must be held.
+func (m *Manager) closePool(slotID uint) {
+	if p, ok := m.pools[slotID]; ok {
+		p.close()
+		delete(m.pools, slotID)
+		m.generation++
+	}
+}
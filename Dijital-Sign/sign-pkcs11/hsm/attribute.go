@@ -0,0 +1,89 @@
+package hsm
+
+import (
+	"encoding/asn1"
+	"encoding/binary"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS#11 v3.0 Edwards-curve constants, not yet exported by github.com/miekg/pkcs11
+const (
+	CKK_EC_EDWARDS              = 0x00000040
+	CKM_EC_EDWARDS_KEY_PAIR_GEN = 0x00001055
+	CKM_EDDSA                   = 0x00001057
+)
+
+// PKCS#11 v3.0 SHA-3 mask generation functions, not yet exported by
+// github.com/miekg/pkcs11
+const (
+	CKG_MGF1_SHA3_224 = 0x00000006
+	CKG_MGF1_SHA3_256 = 0x00000007
+	CKG_MGF1_SHA3_384 = 0x00000008
+	CKG_MGF1_SHA3_512 = 0x00000009
+)
+
+// CurveOIDs maps the supported curve names to their OIDs
+// (RFC 5480, section 2.1.1.1 and RFC 8410, section 3)
+var CurveOIDs = map[string]asn1.ObjectIdentifier{
+	"P-256":   {1, 2, 840, 10045, 3, 1, 7},
+	"P-384":   {1, 3, 132, 0, 34},
+	"P-521":   {1, 3, 132, 0, 35},
+	"Ed25519": {1, 3, 101, 112},
+}
+
+// CurveName returns the curve name for a DER encoded CKA_EC_PARAMS value,
+// or an empty string when the curve is unknown
+func CurveName(ecParams []byte) string {
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(ecParams, &oid); err != nil {
+		// Some tokens store Edwards curves by name (PrintableString)
+		var name string
+		if _, err := asn1.Unmarshal(ecParams, &name); err == nil && name == "edwards25519" {
+			return "Ed25519"
+		}
+		return ""
+	}
+	for name, curveOID := range CurveOIDs {
+		if oid.Equal(curveOID) {
+			return name
+		}
+	}
+	return ""
+}
+
+// Ulong decodes a CK_ULONG attribute value, which the library returns in
+// native byte order and width
+func Ulong(value []byte) uint {
+	switch len(value) {
+	case 4:
+		return uint(binary.NativeEndian.Uint32(value))
+	case 8:
+		return uint(binary.NativeEndian.Uint64(value))
+	}
+	return 0
+}
+
+// Bool decodes a CK_BBOOL attribute value
+func Bool(value []byte) bool {
+	return len(value) == 1 && value[0] != 0
+}
+
+// ClassNames maps object classes to the names used in API requests and responses
+var ClassNames = map[uint]string{
+	pkcs11.CKO_DATA:        "data",
+	pkcs11.CKO_CERTIFICATE: "certificate",
+	pkcs11.CKO_PUBLIC_KEY:  "public",
+	pkcs11.CKO_PRIVATE_KEY: "private",
+	pkcs11.CKO_SECRET_KEY:  "secret",
+}
+
+// KeyTypeNames maps key types to the names used in API responses
+var KeyTypeNames = map[uint]string{
+	pkcs11.CKK_RSA:            "RSA",
+	pkcs11.CKK_EC:             "EC",
+	CKK_EC_EDWARDS:            "EC_EDWARDS",
+	pkcs11.CKK_AES:            "AES",
+	pkcs11.CKK_DES3:           "DES3",
+	pkcs11.CKK_GENERIC_SECRET: "GENERIC_SECRET",
+}
@@ -0,0 +1,149 @@
+package hsm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ErrMechanismUnsupported matches every MechanismError with errors.Is
+var ErrMechanismUnsupported = errors.New("mechanism not supported")
+
+// Reasons reported in MechanismError
+const (
+	ReasonUnsupported       = "unsupported"
+	ReasonOperationDenied   = "operation_not_supported"
+	ReasonKeySizeOutOfRange = "key_size_out_of_range"
+)
+
+// MechanismError describes why a slot cannot run an operation. It is meant
+// to be returned to clients as is.
+type MechanismError struct {
+	Provider     string   `json:"provider"`
+	SlotID       int      `json:"slot_id"`
+	Mechanism    string   `json:"mechanism"`
+	Operation    string   `json:"operation"`
+	Reason       string   `json:"reason"`
+	KeySize      uint     `json:"key_size,omitempty"`
+	MinKeySize   uint     `json:"min_key_size,omitempty"`
+	MaxKeySize   uint     `json:"max_key_size,omitempty"`
+	Alternatives []string `json:"alternatives,omitempty"`
+}
+
+func (e *MechanismError) Error() string {
+	var msg string
+	switch e.Reason {
+	case ReasonKeySizeOutOfRange:
+		msg = fmt.Sprintf("key size %d is outside the range %d-%d supported by %s on slot %d", e.KeySize, e.MinKeySize, e.MaxKeySize, e.Mechanism, e.SlotID)
+	case ReasonOperationDenied:
+		msg = fmt.Sprintf("%s on slot %d does not support %s", e.Mechanism, e.SlotID, e.Operation)
+	default:
+		msg = fmt.Sprintf("slot %d does not support %s", e.SlotID, e.Mechanism)
+	}
+	if len(e.Alternatives) > 0 {
+		msg += fmt.Sprintf("; mechanisms supporting %s on this slot: %s", e.Operation, strings.Join(e.Alternatives, ", "))
+	}
+	return msg
+}
+
+// Unwrap lets errors.Is match ErrMechanismUnsupported
+func (e *MechanismError) Unwrap() error {
+	return ErrMechanismUnsupported
+}
+
+// operationNames names the mechanism flags that CheckMechanism accepts
+var operationNames = map[uint]string{
+	pkcs11.CKF_ENCRYPT:           "encrypt",
+	pkcs11.CKF_DECRYPT:           "decrypt",
+	pkcs11.CKF_DIGEST:            "digest",
+	pkcs11.CKF_SIGN:              "sign",
+	pkcs11.CKF_VERIFY:            "verify",
+	pkcs11.CKF_GENERATE:          "generate",
+	pkcs11.CKF_GENERATE_KEY_PAIR: "generate_key_pair",
+	pkcs11.CKF_WRAP:              "wrap",
+	pkcs11.CKF_UNWRAP:            "unwrap",
+	pkcs11.CKF_DERIVE:            "derive",
+}
+
+// CheckMechanism verifies with C_GetMechanismInfo that the slot supports the
+// mechanism for the operation flag (CKF_SIGN, CKF_GENERATE_KEY_PAIR, ...)
+// and, when keySize is not 0, that the size is within the token's range.
+// Mechanism information is cached per slot. Tokens that cannot list their
+// mechanisms are not checked. HA groups are checked on the primary member.
+func CheckMechanism(provider string, slotID int, mechanism uint, operation uint, keySize uint) error {
+	provider, slotID, err := route(provider, slotID)
+	if err != nil {
+		return err
+	}
+	m, err := Lookup(provider)
+	if err != nil {
+		return err
+	}
+	mechanisms, err := m.mechanisms(uint(slotID))
+	if err != nil {
+		return nil
+	}
+
+	mechErr := &MechanismError{
+		Provider:  m.Name(),
+		SlotID:    slotID,
+		Mechanism: MechanismName(mechanism),
+		Operation: operationNames[operation],
+	}
+	info, ok := mechanisms[mechanism]
+	switch {
+	case !ok:
+		mechErr.Reason = ReasonUnsupported
+	case info.Flags&operation == 0:
+		mechErr.Reason = ReasonOperationDenied
+	case keySize != 0 && (keySize < info.MinKeySize || (info.MaxKeySize != 0 && keySize > info.MaxKeySize)):
+		mechErr.Reason = ReasonKeySizeOutOfRange
+		mechErr.KeySize = keySize
+		mechErr.MinKeySize = info.MinKeySize
+		mechErr.MaxKeySize = info.MaxKeySize
+		return mechErr
+	default:
+		return nil
+	}
+
+	for mech, info := range mechanisms {
+		if info.Flags&operation != 0 {
+			mechErr.Alternatives = append(mechErr.Alternatives, MechanismName(mech))
+		}
+	}
+	sort.Strings(mechErr.Alternatives)
+	return mechErr
+}
+
+// mechanisms returns the cached mechanism information of a slot, reading it
+// from the token on first use
+func (m *Manager) mechanisms(slotID uint) (map[uint]pkcs11.MechanismInfo, error) {
+	m.mechMu.Lock()
+	defer m.mechMu.Unlock()
+
+	if cached, ok := m.mechCache[slotID]; ok {
+		return cached, nil
+	}
+
+	list, err := m.ctx.GetMechanismList(slotID)
+	if err != nil {
+		return nil, fmt.Errorf("GetMechanismList failed: %w", err)
+	}
+	mechanisms := make(map[uint]pkcs11.MechanismInfo, len(list))
+	for _, mech := range list {
+		info, err := m.ctx.GetMechanismInfo(slotID, []*pkcs11.Mechanism{mech})
+		if err != nil {
+			return nil, fmt.Errorf("GetMechanismInfo failed for %s: %w", MechanismName(mech.Mechanism), err)
+		}
+		mechanisms[mech.Mechanism] = info
+	}
+
+	if m.mechCache == nil {
+		m.mechCache = map[uint]map[uint]pkcs11.MechanismInfo{}
+	}
+	m.mechCache[slotID] = mechanisms
+	return mechanisms, nil
+}
@@ -0,0 +1,40 @@
+package hsm
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// StoreCertificate creates a token CKO_CERTIFICATE object for an X.509
+// certificate. The id links the certificate to its key pair's CKA_ID and may
+// be nil.
+func (s *Session) StoreCertificate(cert *x509.Certificate, label string, id []byte) (pkcs11.ObjectHandle, error) {
+	serial, err := asn1.Marshal(cert.SerialNumber)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode certificate serial: %w", err)
+	}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+		pkcs11.NewAttribute(pkcs11.CKA_CERTIFICATE_TYPE, pkcs11.CKC_X_509),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_SUBJECT, cert.RawSubject),
+		pkcs11.NewAttribute(pkcs11.CKA_ISSUER, cert.RawIssuer),
+		pkcs11.NewAttribute(pkcs11.CKA_SERIAL_NUMBER, serial),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, cert.Raw),
+	}
+	if len(id) > 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+	}
+
+	handle, err := s.Ctx.CreateObject(s.Handle, template)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store certificate %s: %w", label, err)
+	}
+	return handle, nil
+}
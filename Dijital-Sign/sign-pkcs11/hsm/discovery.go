@@ -0,0 +1,227 @@
+package hsm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ErrTokenNotFound is returned when no slot holds the requested token
+var ErrTokenNotFound = errors.New("token not found")
+
+// SlotInfo describes a slot and the token in it, if any
+type SlotInfo struct {
+	ID           uint       `json:"id"`
+	Description  string     `json:"description"`
+	Manufacturer string     `json:"manufacturer"`
+	Flags        []string   `json:"flags"`
+	Token        *TokenInfo `json:"token,omitempty"`
+}
+
+// TokenInfo describes a token. Counters the token does not report are -1;
+// a maximum of 0 means unlimited.
+type TokenInfo struct {
+	Label              string   `json:"label"`
+	Manufacturer       string   `json:"manufacturer"`
+	Model              string   `json:"model"`
+	Serial             string   `json:"serial"`
+	Flags              []string `json:"flags"`
+	Sessions           int64    `json:"sessions"`
+	MaxSessions        int64    `json:"max_sessions"`
+	RwSessions         int64    `json:"rw_sessions"`
+	MaxRwSessions      int64    `json:"max_rw_sessions"`
+	MinPinLength       uint     `json:"min_pin_length"`
+	MaxPinLength       uint     `json:"max_pin_length"`
+	FreePublicMemory   int64    `json:"free_public_memory"`
+	TotalPublicMemory  int64    `json:"total_public_memory"`
+	FreePrivateMemory  int64    `json:"free_private_memory"`
+	TotalPrivateMemory int64    `json:"total_private_memory"`
+	HardwareVersion    string   `json:"hardware_version"`
+	FirmwareVersion    string   `json:"firmware_version"`
+}
+
+// MechanismInfo describes a mechanism supported by a slot
+type MechanismInfo struct {
+	Name       string   `json:"name"`
+	Type       uint     `json:"type"`
+	MinKeySize uint     `json:"min_key_size"`
+	MaxKeySize uint     `json:"max_key_size"`
+	Flags      []string `json:"flags"`
+}
+
+// TokenRef selects the provider of a request and addresses a token by label
+// or serial number instead of slot ID. It is embedded in request structs
+// next to SlotId.
+type TokenRef struct {
+	Provider    string `json:"Provider" form:"Provider"`
+	TokenLabel  string `json:"TokenLabel" form:"TokenLabel"`
+	TokenSerial string `json:"TokenSerial" form:"TokenSerial"`
+}
+
+// Resolve checks the provider and returns the slot holding the referenced
+// token. Without TokenLabel and TokenSerial it returns slotID, or the
+// provider's default slot when slotID is nil.
+func (r TokenRef) Resolve(slotID *int) (int, error) {
+	defaultSlot, err := DefaultSlot(r.Provider)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case r.TokenLabel != "" || r.TokenSerial != "":
+		if g, err := lookupGroup(r.Provider); err != nil || g != nil {
+			return 0, fmt.Errorf("HA group %s selects the slot per member; TokenLabel and TokenSerial cannot be used", r.Provider)
+		}
+		return FindSlot(r.Provider, r.TokenLabel, r.TokenSerial)
+	case slotID != nil:
+		return *slotID, nil
+	}
+	return defaultSlot, nil
+}
+
+// ListSlots returns every slot of a provider with its token information.
+// With tokenPresent set only slots holding a token are listed.
+func ListSlots(provider string, tokenPresent bool) ([]SlotInfo, error) {
+	m, err := Lookup(provider)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := m.ctx.GetSlotList(tokenPresent)
+	if err != nil {
+		return nil, fmt.Errorf("GetSlotList failed: %w", err)
+	}
+
+	slots := []SlotInfo{}
+	for _, id := range ids {
+		slot, err := slotInfo(m.ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		slots = append(slots, *slot)
+	}
+	return slots, nil
+}
+
+// GetSlot returns the information of one slot and its token
+func GetSlot(provider string, slotID int) (*SlotInfo, error) {
+	m, err := Lookup(provider)
+	if err != nil {
+		return nil, err
+	}
+	return slotInfo(m.ctx, uint(slotID))
+}
+
+// Mechanisms returns the mechanisms the slot's token supports
+func Mechanisms(provider string, slotID int) ([]MechanismInfo, error) {
+	m, err := Lookup(provider)
+	if err != nil {
+		return nil, err
+	}
+	list, err := m.ctx.GetMechanismList(uint(slotID))
+	if err != nil {
+		return nil, fmt.Errorf("GetMechanismList failed: %w", err)
+	}
+
+	mechanisms := []MechanismInfo{}
+	for _, mech := range list {
+		info, err := m.ctx.GetMechanismInfo(uint(slotID), []*pkcs11.Mechanism{mech})
+		if err != nil {
+			return nil, fmt.Errorf("GetMechanismInfo failed for %s: %w", MechanismName(mech.Mechanism), err)
+		}
+		mechanisms = append(mechanisms, MechanismInfo{
+			Name:       MechanismName(mech.Mechanism),
+			Type:       mech.Mechanism,
+			MinKeySize: info.MinKeySize,
+			MaxKeySize: info.MaxKeySize,
+			Flags:      flagNames(info.Flags, mechanismFlagNames),
+		})
+	}
+	return mechanisms, nil
+}
+
+// FindSlot returns the slot of a provider whose token has the label and/or
+// serial number. Tokens pad both fields with spaces, which are ignored.
+func FindSlot(provider string, label string, serial string) (int, error) {
+	m, err := Lookup(provider)
+	if err != nil {
+		return 0, err
+	}
+	ids, err := m.ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("GetSlotList failed: %w", err)
+	}
+
+	found := -1
+	for _, id := range ids {
+		token, err := m.ctx.GetTokenInfo(id)
+		if err != nil {
+			continue
+		}
+		if label != "" && strings.TrimSpace(token.Label) != label {
+			continue
+		}
+		if serial != "" && strings.TrimSpace(token.SerialNumber) != serial {
+			continue
+		}
+		if found >= 0 {
+			return 0, fmt.Errorf("more than one token matches label %q serial %q, use TokenSerial or SlotId", label, serial)
+		}
+		found = int(id)
+	}
+	if found < 0 {
+		return 0, fmt.Errorf("%w: label %q serial %q", ErrTokenNotFound, label, serial)
+	}
+	return found, nil
+}
+
+// slotInfo reads the slot and, when present, token information
+func slotInfo(ctx *pkcs11.Ctx, id uint) (*SlotInfo, error) {
+	info, err := ctx.GetSlotInfo(id)
+	if err != nil {
+		return nil, fmt.Errorf("GetSlotInfo failed for slot %d: %w", id, err)
+	}
+	slot := &SlotInfo{
+		ID:           id,
+		Description:  strings.TrimSpace(info.SlotDescription),
+		Manufacturer: strings.TrimSpace(info.ManufacturerID),
+		Flags:        flagNames(info.Flags, slotFlagNames),
+	}
+	if info.Flags&pkcs11.CKF_TOKEN_PRESENT == 0 {
+		return slot, nil
+	}
+
+	token, err := ctx.GetTokenInfo(id)
+	if err != nil {
+		return nil, fmt.Errorf("GetTokenInfo failed for slot %d: %w", id, err)
+	}
+	slot.Token = &TokenInfo{
+		Label:              strings.TrimSpace(token.Label),
+		Manufacturer:       strings.TrimSpace(token.ManufacturerID),
+		Model:              strings.TrimSpace(token.Model),
+		Serial:             strings.TrimSpace(token.SerialNumber),
+		Flags:              flagNames(token.Flags, tokenFlagNames),
+		Sessions:           counter(token.SessionCount),
+		MaxSessions:        counter(token.MaxSessionCount),
+		RwSessions:         counter(token.RwSessionCount),
+		MaxRwSessions:      counter(token.MaxRwSessionCount),
+		MinPinLength:       token.MinPinLen,
+		MaxPinLength:       token.MaxPinLen,
+		FreePublicMemory:   counter(token.FreePublicMemory),
+		TotalPublicMemory:  counter(token.TotalPublicMemory),
+		FreePrivateMemory:  counter(token.FreePrivateMemory),
+		TotalPrivateMemory: counter(token.TotalPrivateMemory),
+		HardwareVersion:    fmt.Sprintf("%d.%d", token.HardwareVersion.Major, token.HardwareVersion.Minor),
+		FirmwareVersion:    fmt.Sprintf("%d.%d", token.FirmwareVersion.Major, token.FirmwareVersion.Minor),
+	}
+	return slot, nil
+}
+
+// counter converts a CK_ULONG counter, mapping CK_UNAVAILABLE_INFORMATION
+// to -1
+func counter(v uint) int64 {
+	if v == pkcs11.CK_UNAVAILABLE_INFORMATION {
+		return -1
+	}
+	return int64(v)
+}
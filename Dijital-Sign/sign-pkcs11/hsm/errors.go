@@ -0,0 +1,8 @@
+package hsm
+
+import "errors"
+
+// ErrInvalidRequest marks errors caused by the caller's input rather than by
+// the token, such as an unknown key profile or an unsupported curve. The
+// packages built on hsm wrap their validation errors with it.
+var ErrInvalidRequest = errors.New("invalid request")
@@ -0,0 +1,465 @@
+package hsm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// DefaultHealthInterval is how often HA group members are checked unless
+// the group configures another interval
+const DefaultHealthInterval = 10 * time.Second
+
+// DefaultProCryptConfig is where the ProCrypt client configuration is
+// mounted unless PROCRYPT_CONFIG says otherwise
+const DefaultProCryptConfig = "/opt/procrypt/km3000/config/config"
+
+// ProCryptGroupName names the HA group built from the ProCrypt configuration
+const ProCryptGroupName = "ha"
+
+// ErrNoHealthyMember is returned when every member of an HA group failed
+var ErrNoHealthyMember = errors.New("no healthy member in HA group")
+
+// Group is a set of equivalent slots, possibly on different providers, that
+// hold the same keys. Requests naming the group as provider are routed to
+// one member: writes such as key generation stick to the primary member,
+// idempotent reads move to another member when one fails.
+type Group struct {
+	Name           string   `json:"name"`
+	Members        []Member `json:"members"`
+	HealthInterval string   `json:"health_interval"` // Go duration, default 10s
+}
+
+// Member is one slot of an HA group
+type Member struct {
+	Provider string `json:"provider"`
+	Slot     int    `json:"slot"`
+}
+
+// MemberStatus is the health of a group member as of the last check
+type MemberStatus struct {
+	Member
+	Healthy   bool       `json:"healthy"`
+	Primary   bool       `json:"primary"`
+	Error     string     `json:"error,omitempty"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+}
+
+// GroupInfo describes an HA group and the health of its members
+type GroupInfo struct {
+	Name           string         `json:"name"`
+	HealthInterval string         `json:"health_interval"`
+	Members        []MemberStatus `json:"members"`
+}
+
+// group is the runtime state of an HA group
+type group struct {
+	config   Group
+	interval time.Duration
+	stop     chan struct{}
+
+	mu      sync.Mutex
+	status  []MemberStatus
+	primary int
+}
+
+// failoverCodes are the return values that mean the device or session is
+// gone rather than that the operation itself failed
+var failoverCodes = []pkcs11.Error{
+	pkcs11.CKR_DEVICE_ERROR,
+	pkcs11.CKR_DEVICE_MEMORY,
+	pkcs11.CKR_DEVICE_REMOVED,
+	pkcs11.CKR_TOKEN_NOT_PRESENT,
+	pkcs11.CKR_TOKEN_NOT_RECOGNIZED,
+	pkcs11.CKR_SESSION_CLOSED,
+	pkcs11.CKR_SESSION_COUNT,
+	pkcs11.CKR_SESSION_HANDLE_INVALID,
+	pkcs11.CKR_SLOT_ID_INVALID,
+	pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED,
+	pkcs11.CKR_GENERAL_ERROR,
+}
+
+// IsDeviceError reports whether err is a device or session failure after
+// which the operation may succeed on another node
+func IsDeviceError(err error) bool {
+	var ckr pkcs11.Error
+	if !errors.As(err, &ckr) {
+		return false
+	}
+	for _, code := range failoverCodes {
+		if ckr == code {
+			return true
+		}
+	}
+	return false
+}
+
+// ProCryptGroup reads the ProCrypt client configuration and, when HIGH_AV is
+// true, returns a group of its active HSMs on the given provider. A ProCrypt
+// HSM Id is not a PKCS#11 slot ID, so slots maps each HSM Id to the slot
+// holding its token; an active HSM missing from slots is an error. A
+// missing file or disabled high availability returns nil.
+func ProCryptGroup(path string, provider string, slots map[int]int) (*Group, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ProCrypt configuration: %w", err)
+	}
+	defer f.Close()
+
+	var (
+		section string
+		enabled bool
+		active  []int
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "*****" && len(fields) > 1:
+			section = fields[1]
+		case section == "HSM" && fields[0] == "HSM" && len(fields) >= 6:
+			id, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid HSM Id %q in %s", fields[1], path)
+			}
+			if fields[5] == "Active" {
+				active = append(active, id)
+			}
+		case fields[0] == "HIGH_AV" && len(fields) > 1:
+			enabled = strings.EqualFold(fields[1], "true")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ProCrypt configuration: %w", err)
+	}
+	if !enabled || len(active) == 0 {
+		return nil, nil
+	}
+
+	members := make([]Member, 0, len(active))
+	for _, id := range active {
+		slot, ok := slots[id]
+		if !ok {
+			return nil, fmt.Errorf("ProCrypt HSM Id %d in %s has no slot in PROCRYPT_SLOTS", id, path)
+		}
+		members = append(members, Member{Provider: provider, Slot: slot})
+	}
+	return &Group{Name: ProCryptGroupName, Members: members}, nil
+}
+
+// ParseProCryptSlots parses the PROCRYPT_SLOTS mapping of ProCrypt HSM Ids
+// to slots, written as comma separated <HSM Id>=<slot> pairs such as
+// "0=1,1=2"
+func ParseProCryptSlots(v string) (map[int]int, error) {
+	slots := map[int]int{}
+	for _, pair := range strings.Split(v, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		idText, slotText, ok := strings.Cut(pair, "=")
+		id, idErr := strconv.Atoi(strings.TrimSpace(idText))
+		slot, slotErr := strconv.Atoi(strings.TrimSpace(slotText))
+		if !ok || idErr != nil || slotErr != nil || slot < 0 {
+			return nil, fmt.Errorf("invalid PROCRYPT_SLOTS entry %q, want <HSM Id>=<slot>", pair)
+		}
+		if _, dup := slots[id]; dup {
+			return nil, fmt.Errorf("HSM Id %d is mapped twice in PROCRYPT_SLOTS", id)
+		}
+		slots[id] = slot
+	}
+	return slots, nil
+}
+
+// CheckGroups checks that the slot of every HA group member holds a token,
+// so that a member mapped to the wrong slot is reported at startup rather
+// than on the first failover
+func CheckGroups() error {
+	registryMu.Lock()
+	r, err := currentRegistry()
+	registryMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, g := range r.config.Groups {
+		for _, member := range g.Members {
+			slot, err := GetSlot(member.Provider, member.Slot)
+			if err != nil {
+				return fmt.Errorf("HA group %s, provider %s slot %d: %w", g.Name, member.Provider, member.Slot, err)
+			}
+			if slot.Token == nil {
+				return fmt.Errorf("%w: HA group %s, provider %s slot %d holds no token", ErrTokenNotFound, g.Name, member.Provider, member.Slot)
+			}
+		}
+	}
+	return nil
+}
+
+// addGroup validates a group against the configured providers
+func (r *registry) addGroup(g Group) error {
+	switch {
+	case g.Name == "":
+		return fmt.Errorf("HA group name is required")
+	case len(g.Members) == 0:
+		return fmt.Errorf("HA group %s has no members", g.Name)
+	}
+	if _, ok := r.providers[g.Name]; ok {
+		return fmt.Errorf("HA group %s has the name of a provider", g.Name)
+	}
+	if _, ok := r.groups[g.Name]; ok {
+		return fmt.Errorf("HA group %s is configured twice", g.Name)
+	}
+
+	interval := DefaultHealthInterval
+	if g.HealthInterval != "" {
+		d, err := time.ParseDuration(g.HealthInterval)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid health_interval of HA group %s: %s", g.Name, g.HealthInterval)
+		}
+		interval = d
+	}
+
+	state := &group{config: g, interval: interval, stop: make(chan struct{})}
+	for _, member := range g.Members {
+		if _, ok := r.providers[member.Provider]; !ok {
+			return fmt.Errorf("%w: %s in HA group %s", ErrProviderNotFound, member.Provider, g.Name)
+		}
+		state.status = append(state.status, MemberStatus{Member: member, Healthy: true})
+	}
+	r.groups[g.Name] = state
+	return nil
+}
+
+// lookupGroup returns the HA group with the name, or nil when the name is a
+// provider
+func lookupGroup(name string) (*group, error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	r, err := currentRegistry()
+	if err != nil {
+		return nil, err
+	}
+	return r.groups[name], nil
+}
+
+// route returns the member a request for provider and slot goes to: the
+// primary member for an HA group, the provider and slot themselves
+// otherwise
+func route(provider string, slotID int) (string, int, error) {
+	g, err := lookupGroup(provider)
+	if err != nil || g == nil {
+		return provider, slotID, err
+	}
+	members, _ := g.members()
+	return members[0].Provider, members[0].Slot, nil
+}
+
+// Failover runs a safe operation, one that changes nothing on the token
+// such as a signature, a verification or a public key read, on the slot.
+// After a lost session, token or module, the slot is reconnected and the
+// operation repeated once. When the provider is an HA group, the operation
+// is tried on the primary member first and repeated on the next member
+// after a device or session error instead. Other errors are returned as
+// they are.
+func Failover(provider string, slotID int, op func(provider string, slotID int) error) error {
+	g, err := lookupGroup(provider)
+	if err != nil {
+		return err
+	}
+	if g == nil {
+		return retry(provider, slotID, op)
+	}
+
+	members, indexes := g.members()
+	var lastErr error
+	for i, member := range members {
+		err := op(member.Provider, member.Slot)
+		if err == nil || !IsDeviceError(err) {
+			return err
+		}
+		g.markDown(indexes[i], err)
+		lastErr = err
+	}
+	return fmt.Errorf("%w %s: %w", ErrNoHealthyMember, g.config.Name, lastErr)
+}
+
+// open borrows a session from the primary member, moving on to the next
+// member when the session cannot be opened. Opening a session changes
+// nothing on the token, so this is safe for every operation. Members are
+// not reconnected here; the health check does that.
+func (g *group) open(pin string) (*Session, error) {
+	members, indexes := g.members()
+	var lastErr error
+	for i, member := range members {
+		m, err := Lookup(member.Provider)
+		if err == nil {
+			var s *Session
+			if s, err = m.open(member.Slot, pin); err == nil {
+				return s, nil
+			}
+			if !IsDeviceError(err) {
+				return nil, err
+			}
+		}
+		g.markDown(indexes[i], err)
+		lastErr = err
+	}
+	return nil, fmt.Errorf("%w %s: %w", ErrNoHealthyMember, g.config.Name, lastErr)
+}
+
+// members returns the members in the order requests try them, with their
+// indexes: the primary first, then the other healthy members. When no
+// member is healthy every member is returned, since the last health check
+// may be out of date.
+func (g *group) members() ([]Member, []int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var (
+		members []Member
+		indexes []int
+	)
+	n := len(g.status)
+	for i := 0; i < n; i++ {
+		idx := (g.primary + i) % n
+		if g.status[idx].Healthy {
+			members = append(members, g.status[idx].Member)
+			indexes = append(indexes, idx)
+		}
+	}
+	if len(members) > 0 {
+		return members, indexes
+	}
+	for i := 0; i < n; i++ {
+		idx := (g.primary + i) % n
+		members = append(members, g.status[idx].Member)
+		indexes = append(indexes, idx)
+	}
+	return members, indexes
+}
+
+// markDown records a failed member. A failed primary hands over to the next
+// healthy member, which stays primary after the old one recovers so that
+// new keys keep going to the same node.
+func (g *group) markDown(idx int, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.setStatus(idx, err)
+}
+
+// setStatus records the result of using or checking a member. g.mu must be
+// held.
+func (g *group) setStatus(idx int, err error) {
+	now := time.Now().UTC()
+	g.status[idx].Healthy = err == nil
+	g.status[idx].Error = ""
+	g.status[idx].CheckedAt = &now
+	if err != nil {
+		g.status[idx].Error = err.Error()
+	}
+
+	if err == nil {
+		// A recovered member takes over only when the primary is down
+		if !g.status[g.primary].Healthy {
+			g.primary = idx
+		}
+		return
+	}
+	if idx != g.primary {
+		return
+	}
+	for i := 1; i < len(g.status); i++ {
+		next := (g.primary + i) % len(g.status)
+		if g.status[next].Healthy {
+			g.primary = next
+			return
+		}
+	}
+}
+
+// watch checks the members every interval until Shutdown
+func (g *group) watch(r *registry) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.check(r)
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// check asks every member's token for its information; a member is healthy
+// when the call succeeds. A member whose module lost its initialisation is
+// initialised again, and a recovered member's pool is closed so that the
+// next request logs in again.
+func (g *group) check(r *registry) {
+	for idx, member := range g.config.Members {
+		registryMu.Lock()
+		if activeRegistry != r {
+			registryMu.Unlock()
+			return
+		}
+		m, err := r.manager(member.Provider)
+		registryMu.Unlock()
+
+		if err == nil {
+			gen := m.Generation()
+			if _, err = m.ctx.GetTokenInfo(uint(member.Slot)); err != nil {
+				err = fmt.Errorf("GetTokenInfo failed: %w", err)
+			}
+			// The interval between checks is the backoff, so one attempt
+			if errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED)) {
+				if rerr := m.reconnect(uint(member.Slot), gen, err, 1); rerr == nil {
+					err = nil
+				}
+			}
+		}
+		g.mu.Lock()
+		recovered := err == nil && !g.status[idx].Healthy
+		g.setStatus(idx, err)
+		g.mu.Unlock()
+		if recovered {
+			m.resetSlot(uint(member.Slot))
+		}
+	}
+}
+
+// ListGroups describes every HA group and the health of its members
+func ListGroups() ([]GroupInfo, error) {
+	registryMu.Lock()
+	r, err := currentRegistry()
+	registryMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []GroupInfo{}
+	for _, g := range r.config.Groups {
+		state := r.groups[g.Name]
+		state.mu.Lock()
+		info := GroupInfo{Name: g.Name, HealthInterval: state.interval.String()}
+		for idx, status := range state.status {
+			status.Primary = idx == state.primary
+			info.Members = append(info.Members, status)
+		}
+		state.mu.Unlock()
+		groups = append(groups, info)
+	}
+	return groups, nil
+}
@@ -0,0 +1,112 @@
+package hsm
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProCryptGroup(t *testing.T) {
+	// ProCrypt HSM Ids are not slot IDs
+	slots := map[int]int{0: 5, 1: 6, 2: 7, 4: 9}
+	const header = "***** HSM\tId\t\tIp\t\t\tPort\t\tType\t\tStatus\t\tDescription\n"
+	tests := []struct {
+		name    string
+		config  string
+		want    *Group
+		wantErr bool
+	}{
+		{
+			name: "high availability disabled",
+			config: header +
+				"HSM\t\t0\t\t172.88.66.3\t\t5000\t\tIndependent\tActive\t\t\n" +
+				"***** HIGH AVAILABILITY mode status\nHIGH_AV\t\tfalse\n",
+		},
+		{
+			name: "active members only",
+			config: header +
+				"HSM\t\t0\t\t172.88.66.3\t\t5000\t\tIndependent\tActive\t\t\n" +
+				"HSM\t\t1\t\t172.88.66.4\t\t5000\t\tIndependent\tPassive\t\t\n" +
+				"HSM\t\t2\t\t172.88.66.5\t\t5000\t\tIndependent\tActive\t\tbackup\n" +
+				"***** PIN\tstatus\nUSER\t\ttrue\n" +
+				"***** HIGH AVAILABILITY mode status\nHIGH_AV\t\tTRUE\n" +
+				"***** DEFAULTS\nDEF_ID\t\t0\n",
+			want: &Group{Name: ProCryptGroupName, Members: []Member{{Provider: "procrypt", Slot: 5}, {Provider: "procrypt", Slot: 7}}},
+		},
+		{
+			name: "no active member",
+			config: header +
+				"HSM\t\t1\t\t172.88.66.4\t\t5000\t\tIndependent\tPassive\t\t\n" +
+				"HIGH_AV\t\ttrue\n",
+		},
+		{
+			name: "HSM lines outside the HSM section",
+			config: "***** DEFAULTS\nHSM\t\t3\t\t172.88.66.3\t\t5000\t\tIndependent\tActive\n" +
+				header + "HSM\t\t4\t\t172.88.66.3\t\t5000\t\tIndependent\tActive\n" +
+				"HIGH_AV\t\ttrue\n",
+			want: &Group{Name: ProCryptGroupName, Members: []Member{{Provider: "procrypt", Slot: 9}}},
+		},
+		{
+			name: "active HSM without a slot",
+			config: header +
+				"HSM\t\t0\t\t172.88.66.3\t\t5000\t\tIndependent\tActive\t\t\n" +
+				"HSM\t\t6\t\t172.88.66.4\t\t5000\t\tIndependent\tActive\t\t\n" +
+				"HIGH_AV\t\ttrue\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid id",
+			config:  header + "HSM\t\tx\t\t172.88.66.3\t\t5000\t\tIndependent\tActive\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config")
+			if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ProCryptGroup(path, "procrypt", slots)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProCryptGroup error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ProCryptGroup = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProCryptGroupMissingFile(t *testing.T) {
+	got, err := ProCryptGroup(filepath.Join(t.TempDir(), "missing"), "procrypt", nil)
+	if got != nil || err != nil {
+		t.Errorf("ProCryptGroup = %v, %v, want nil, nil", got, err)
+	}
+}
+
+func TestParseProCryptSlots(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[int]int
+		wantErr bool
+	}{
+		{value: "", want: map[int]int{}},
+		{value: "0=1", want: map[int]int{0: 1}},
+		{value: " 0 = 1, 2=3 ,", want: map[int]int{0: 1, 2: 3}},
+		{value: "0", wantErr: true},
+		{value: "0=x", wantErr: true},
+		{value: "0=-1", wantErr: true},
+		{value: "0=1,0=2", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseProCryptSlots(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseProCryptSlots(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseProCryptSlots(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
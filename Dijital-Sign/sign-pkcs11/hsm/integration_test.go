@@ -0,0 +1,94 @@
+package hsm
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+// integration returns the default manager, its default slot and the user
+// PIN of a real token, for instance SoftHSM, and skips the test when
+// PKCS11_LIB is not set. The token in PKCS11_DEFAULT_SLOT (default 0) must
+// be initialised with the user PIN PKCS11_PIN.
+func integration(t *testing.T) (*Manager, int, string) {
+	t.Helper()
+	if os.Getenv("PKCS11_LIB") == "" {
+		t.Skip("PKCS11_LIB is not set")
+	}
+	pin := os.Getenv("PKCS11_PIN")
+	if pin == "" {
+		t.Fatal("PKCS11_PIN must be set with PKCS11_LIB")
+	}
+	t.Cleanup(Shutdown)
+
+	m, err := Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slotID, err := DefaultSlot("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, slotID, pin
+}
+
+func TestPoolPINFailuresIntegration(t *testing.T) {
+	m, slotID, pin := integration(t)
+
+	s, err := m.Open(slotID, pin)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s.Close()
+
+	// Wrong PINs fail only their own request: the pool stays open and a
+	// session borrowed meanwhile keeps working
+	borrowed, err := m.Open(slotID, pin)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer borrowed.Close()
+	for i := 1; i <= 5; i++ {
+		_, err := m.Open(slotID, pin+"-wrong")
+		if !errors.Is(err, pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)) {
+			t.Fatalf("Open with a wrong PIN, attempt %d: %v, want CKR_PIN_INCORRECT", i, err)
+		}
+	}
+	m.mu.Lock()
+	_, open := m.pools[uint(slotID)]
+	m.mu.Unlock()
+	if !open {
+		t.Fatal("pool closed after repeated wrong PINs")
+	}
+	if _, err := borrowed.Ctx.GetSessionInfo(borrowed.Handle); err != nil {
+		t.Fatalf("borrowed session after repeated wrong PINs: %v", err)
+	}
+
+	s, err = m.Open(slotID, pin)
+	if err != nil {
+		t.Fatalf("Open with the right PIN after wrong PINs: %v", err)
+	}
+	s.Close()
+}
+
+func TestRandomIntegration(t *testing.T) {
+	_, slotID, pin := integration(t)
+
+	random, err := Random("", slotID, pin, 32)
+	if err != nil {
+		t.Fatalf("Random: %v", err)
+	}
+	if len(random) != 32 {
+		t.Errorf("Random returned %d bytes, want 32", len(random))
+	}
+	for _, n := range []int{0, MaxRandomLength + 1} {
+		if _, err := Random("", slotID, pin, n); err == nil {
+			t.Errorf("Random accepted length %d", n)
+		}
+	}
+	if _, err := Random("", slotID, pin+"-wrong", 32); !errors.Is(err, pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)) {
+		t.Errorf("Random with a wrong PIN: %v, want CKR_PIN_INCORRECT", err)
+	}
+}
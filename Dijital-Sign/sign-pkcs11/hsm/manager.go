@@ -0,0 +1,251 @@
+package hsm
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// DefaultPoolSize is the number of sessions kept per slot unless the
+// provider configures another size
+const DefaultPoolSize = 4
+
+// acquireTimeout bounds how long Open waits for a free pooled session
+const acquireTimeout = 30 * time.Second
+
+// ErrManagerClosed is returned by Open after Shutdown
+var ErrManagerClosed = errors.New("PKCS#11 module manager is shut down")
+
+// ErrNoFreeSession is returned by Open when every pooled session of the
+// slot stayed in use for acquireTimeout
+var ErrNoFreeSession = errors.New("no free session")
+
+// Manager owns the PKCS#11 module of one provider. C_Initialize and
+// C_Finalize are global to the process, so the module is initialised once
+// and every slot gets a pool of logged-in sessions that callers borrow with
+// Open and give back with Session.Close.
+type Manager struct {
+	mu       sync.Mutex
+	ctx      *pkcs11.Ctx
+	provider Provider
+	pools    map[uint]*pool
+	closed   bool
+
+	// generation is incremented by every reconnect, so that callers failing
+	// on the same outage reconnect only once
+	generation uint64
+	reconnects map[uint]*reconnectCall
+
+	mechMu    sync.Mutex
+	mechCache map[uint]map[uint]pkcs11.MechanismInfo
+}
+
+// pool is the set of sessions of one slot. PKCS#11 login state is shared by
+// all sessions of an application on a token, so the pool logs in once and
+// remembers the PIN to check later borrowers against it.
+//
+// A token that is already logged in does not check the PIN of another
+// C_Login, so wrong PINs presented to the pool never reach the token's
+// retry counter. A wrong PIN only fails the request that sent it: closing
+// the pool would abort every session other requests have borrowed. Callers
+// that accept PINs from clients must limit repeated failures themselves.
+type pool struct {
+	m      *Manager
+	slotID uint
+	pin    string
+	idle   chan pkcs11.SessionHandle
+	tokens chan struct{} // one entry per open session, bounded by the pool size
+	stale  atomic.Bool   // set once the pool is closed
+}
+
+// NewManager loads and initialises the PKCS#11 module of a provider
+func NewManager(provider Provider) (*Manager, error) {
+	if provider.Library == "" {
+		return nil, fmt.Errorf("PKCS#11 library path is not set")
+	}
+	if provider.PoolSize <= 0 {
+		provider.PoolSize = DefaultPoolSize
+	}
+	if provider.ReconnectAttempts <= 0 {
+		provider.ReconnectAttempts = DefaultReconnectAttempts
+	}
+	// Env is process-wide; the registry rejects providers that disagree on it
+	for k, v := range provider.Env {
+		os.Setenv(k, v)
+	}
+
+	p := pkcs11.New(provider.Library)
+	if p == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 library: %s", provider.Library)
+	}
+	if err := p.Initialize(); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		p.Destroy()
+		return nil, fmt.Errorf("failed to initialize PKCS#11 library: %w", err)
+	}
+	return &Manager{ctx: p, provider: provider, pools: map[uint]*pool{}}, nil
+}
+
+// Name returns the name of the manager's provider
+func (m *Manager) Name() string {
+	return m.provider.Name
+}
+
+// Ctx returns the initialised module for calls that need no session, such
+// as slot and token queries
+func (m *Manager) Ctx() *pkcs11.Ctx {
+	return m.ctx
+}
+
+// Open borrows a logged-in read/write session on the slot. The first call
+// for a slot logs in with the PIN; later calls must present the same PIN,
+// and repeated wrong PINs make the pool log in again (see pool).
+// When the session, token or module is gone, Open reconnects and tries
+// once more. Close must be called to return the session to the pool.
+func (m *Manager) Open(slotID int, pin string) (*Session, error) {
+	gen := m.Generation()
+	s, err := m.open(slotID, pin)
+	if err == nil || !NeedsReconnect(err) {
+		return s, err
+	}
+	if err := m.Reconnect(slotID, gen, err); err != nil {
+		return nil, err
+	}
+	return m.open(slotID, pin)
+}
+
+// open borrows a session without reconnecting
+func (m *Manager) open(slotID int, pin string) (*Session, error) {
+	p, err := m.pool(uint(slotID), pin)
+	if err != nil {
+		return nil, err
+	}
+	return p.get(slotID, pin)
+}
+
+// pool returns the session pool of a slot, logging in on first use
+func (m *Manager) pool(slotID uint, pin string) (*pool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, ErrManagerClosed
+	}
+	if p, ok := m.pools[slotID]; ok {
+		return p, nil
+	}
+	return m.newPool(slotID, pin)
+}
+
+// newPool logs in to a slot and creates its pool. m.mu must be held.
+func (m *Manager) newPool(slotID uint, pin string) (*pool, error) {
+	session, err := m.ctx.OpenSession(slotID, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session: %w", err)
+	}
+	if err := m.ctx.Login(session, pkcs11.CKU_USER, pin); err != nil {
+		m.ctx.CloseSession(session)
+		return nil, fmt.Errorf("failed to log in: %w", err)
+	}
+
+	p := &pool{
+		m:      m,
+		slotID: slotID,
+		pin:    pin,
+		idle:   make(chan pkcs11.SessionHandle, m.provider.PoolSize),
+		tokens: make(chan struct{}, m.provider.PoolSize),
+	}
+	p.tokens <- struct{}{}
+	p.idle <- session
+	m.pools[slotID] = p
+	return p, nil
+}
+
+// Close logs out of every slot, closes all sessions and finalises the module
+func (m *Manager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return
+	}
+	m.closed = true
+	for slotID := range m.pools {
+		m.closePool(slotID)
+	}
+	m.ctx.Finalize()
+}
+
+// get hands out an idle session, or opens a new one while the pool is
+// below its size, waiting up to acquireTimeout otherwise
+func (p *pool) get(slotID int, pin string) (*Session, error) {
+	if err := p.checkPIN(pin); err != nil {
+		return nil, err
+	}
+
+	select {
+	case handle := <-p.idle:
+		return &Session{Ctx: p.m.ctx, Handle: handle, SlotID: slotID, Provider: p.m.provider.Name, pool: p}, nil
+	default:
+	}
+
+	timer := time.NewTimer(acquireTimeout)
+	defer timer.Stop()
+	select {
+	case handle := <-p.idle:
+		return &Session{Ctx: p.m.ctx, Handle: handle, SlotID: slotID, Provider: p.m.provider.Name, pool: p}, nil
+	case p.tokens <- struct{}{}:
+		// Sessions opened after login inherit the logged-in state
+		handle, err := p.m.ctx.OpenSession(p.slotID, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			<-p.tokens
+			return nil, fmt.Errorf("failed to open session: %w", err)
+		}
+		return &Session{Ctx: p.m.ctx, Handle: handle, SlotID: slotID, Provider: p.m.provider.Name, pool: p}, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("%w on slot %d after %s", ErrNoFreeSession, slotID, acquireTimeout)
+	}
+}
+
+// checkPIN compares pin with the PIN the pool logged in with
+func (p *pool) checkPIN(pin string) error {
+	p.m.mu.Lock()
+	current := p.pin
+	p.m.mu.Unlock()
+	if subtle.ConstantTimeCompare([]byte(pin), []byte(current)) == 1 {
+		return nil
+	}
+	return fmt.Errorf("failed to log in: %w", pkcs11.Error(pkcs11.CKR_PIN_INCORRECT))
+}
+
+// put returns a session to the pool. Sessions the token no longer knows
+// are dropped so a later get opens a fresh one. Sessions of a closed pool
+// are left alone: the handle may already belong to a newer session.
+func (p *pool) put(handle pkcs11.SessionHandle) {
+	if p.stale.Load() {
+		return
+	}
+	if _, err := p.m.ctx.GetSessionInfo(handle); err != nil {
+		p.m.ctx.CloseSession(handle)
+		<-p.tokens
+		return
+	}
+	p.idle <- handle
+}
+
+// close logs out and closes every session of the slot, including borrowed
+// ones; their holders get CKR_SESSION_HANDLE_INVALID on further calls
+func (p *pool) close() {
+	p.stale.Store(true)
+	select {
+	case handle := <-p.idle:
+		p.m.ctx.Logout(handle)
+	default:
+	}
+	p.m.ctx.CloseAllSessions(p.slotID)
+}
@@ -0,0 +1,132 @@
+package hsm
+
+import (
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// MechanismNames maps common CKM_* values to their names
+var MechanismNames = map[uint]string{
+	pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN:  "CKM_RSA_PKCS_KEY_PAIR_GEN",
+	pkcs11.CKM_RSA_PKCS:               "CKM_RSA_PKCS",
+	pkcs11.CKM_RSA_X_509:              "CKM_RSA_X_509",
+	pkcs11.CKM_RSA_PKCS_OAEP:          "CKM_RSA_PKCS_OAEP",
+	pkcs11.CKM_RSA_PKCS_PSS:           "CKM_RSA_PKCS_PSS",
+	pkcs11.CKM_SHA1_RSA_PKCS:          "CKM_SHA1_RSA_PKCS",
+	pkcs11.CKM_SHA256_RSA_PKCS:        "CKM_SHA256_RSA_PKCS",
+	pkcs11.CKM_SHA384_RSA_PKCS:        "CKM_SHA384_RSA_PKCS",
+	pkcs11.CKM_SHA512_RSA_PKCS:        "CKM_SHA512_RSA_PKCS",
+	pkcs11.CKM_SHA1_RSA_PKCS_PSS:      "CKM_SHA1_RSA_PKCS_PSS",
+	pkcs11.CKM_SHA256_RSA_PKCS_PSS:    "CKM_SHA256_RSA_PKCS_PSS",
+	pkcs11.CKM_SHA384_RSA_PKCS_PSS:    "CKM_SHA384_RSA_PKCS_PSS",
+	pkcs11.CKM_SHA512_RSA_PKCS_PSS:    "CKM_SHA512_RSA_PKCS_PSS",
+	pkcs11.CKM_EC_KEY_PAIR_GEN:        "CKM_EC_KEY_PAIR_GEN",
+	pkcs11.CKM_ECDSA:                  "CKM_ECDSA",
+	pkcs11.CKM_ECDSA_SHA1:             "CKM_ECDSA_SHA1",
+	pkcs11.CKM_ECDSA_SHA256:           "CKM_ECDSA_SHA256",
+	pkcs11.CKM_ECDSA_SHA384:           "CKM_ECDSA_SHA384",
+	pkcs11.CKM_ECDSA_SHA512:           "CKM_ECDSA_SHA512",
+	pkcs11.CKM_ECDH1_DERIVE:           "CKM_ECDH1_DERIVE",
+	CKM_EC_EDWARDS_KEY_PAIR_GEN:       "CKM_EC_EDWARDS_KEY_PAIR_GEN",
+	CKM_EDDSA:                         "CKM_EDDSA",
+	pkcs11.CKM_AES_KEY_GEN:            "CKM_AES_KEY_GEN",
+	pkcs11.CKM_AES_ECB:                "CKM_AES_ECB",
+	pkcs11.CKM_AES_CBC:                "CKM_AES_CBC",
+	pkcs11.CKM_AES_CBC_PAD:            "CKM_AES_CBC_PAD",
+	pkcs11.CKM_AES_CTR:                "CKM_AES_CTR",
+	pkcs11.CKM_AES_GCM:                "CKM_AES_GCM",
+	pkcs11.CKM_AES_CMAC:               "CKM_AES_CMAC",
+	pkcs11.CKM_AES_KEY_WRAP:           "CKM_AES_KEY_WRAP",
+	pkcs11.CKM_AES_KEY_WRAP_PAD:       "CKM_AES_KEY_WRAP_PAD",
+	pkcs11.CKM_DES3_KEY_GEN:           "CKM_DES3_KEY_GEN",
+	pkcs11.CKM_DES3_CBC:               "CKM_DES3_CBC",
+	pkcs11.CKM_GENERIC_SECRET_KEY_GEN: "CKM_GENERIC_SECRET_KEY_GEN",
+	pkcs11.CKM_SHA_1:                  "CKM_SHA_1",
+	pkcs11.CKM_SHA224:                 "CKM_SHA224",
+	pkcs11.CKM_SHA256:                 "CKM_SHA256",
+	pkcs11.CKM_SHA384:                 "CKM_SHA384",
+	pkcs11.CKM_SHA512:                 "CKM_SHA512",
+	pkcs11.CKM_SHA256_HMAC:            "CKM_SHA256_HMAC",
+	pkcs11.CKM_SHA384_HMAC:            "CKM_SHA384_HMAC",
+	pkcs11.CKM_SHA512_HMAC:            "CKM_SHA512_HMAC",
+}
+
+// MechanismName returns the name of a mechanism, or its hex value when the
+// name is not known
+func MechanismName(mechanism uint) string {
+	if name, ok := MechanismNames[mechanism]; ok {
+		return name
+	}
+	if mechanism >= pkcs11.CKM_VENDOR_DEFINED {
+		return fmt.Sprintf("CKM_VENDOR_DEFINED+0x%x", mechanism-pkcs11.CKM_VENDOR_DEFINED)
+	}
+	return fmt.Sprintf("0x%08x", mechanism)
+}
+
+// flagName names one bit of a flags word
+type flagName struct {
+	flag uint
+	name string
+}
+
+// flagNames lists the names of the bits set in flags, in table order
+func flagNames(flags uint, names []flagName) []string {
+	set := []string{}
+	for _, f := range names {
+		if flags&f.flag != 0 {
+			set = append(set, f.name)
+		}
+	}
+	return set
+}
+
+var slotFlagNames = []flagName{
+	{pkcs11.CKF_TOKEN_PRESENT, "token_present"},
+	{pkcs11.CKF_REMOVABLE_DEVICE, "removable_device"},
+	{pkcs11.CKF_HW_SLOT, "hw_slot"},
+}
+
+var tokenFlagNames = []flagName{
+	{pkcs11.CKF_RNG, "rng"},
+	{pkcs11.CKF_WRITE_PROTECTED, "write_protected"},
+	{pkcs11.CKF_LOGIN_REQUIRED, "login_required"},
+	{pkcs11.CKF_USER_PIN_INITIALIZED, "user_pin_initialized"},
+	{pkcs11.CKF_RESTORE_KEY_NOT_NEEDED, "restore_key_not_needed"},
+	{pkcs11.CKF_CLOCK_ON_TOKEN, "clock_on_token"},
+	{pkcs11.CKF_PROTECTED_AUTHENTICATION_PATH, "protected_authentication_path"},
+	{pkcs11.CKF_DUAL_CRYPTO_OPERATIONS, "dual_crypto_operations"},
+	{pkcs11.CKF_TOKEN_INITIALIZED, "token_initialized"},
+	{pkcs11.CKF_SECONDARY_AUTHENTICATION, "secondary_authentication"},
+	{pkcs11.CKF_USER_PIN_COUNT_LOW, "user_pin_count_low"},
+	{pkcs11.CKF_USER_PIN_FINAL_TRY, "user_pin_final_try"},
+	{pkcs11.CKF_USER_PIN_LOCKED, "user_pin_locked"},
+	{pkcs11.CKF_USER_PIN_TO_BE_CHANGED, "user_pin_to_be_changed"},
+	{pkcs11.CKF_SO_PIN_COUNT_LOW, "so_pin_count_low"},
+	{pkcs11.CKF_SO_PIN_FINAL_TRY, "so_pin_final_try"},
+	{pkcs11.CKF_SO_PIN_LOCKED, "so_pin_locked"},
+	{pkcs11.CKF_SO_PIN_TO_BE_CHANGED, "so_pin_to_be_changed"},
+	{pkcs11.CKF_ERROR_STATE, "error_state"},
+}
+
+var mechanismFlagNames = []flagName{
+	{pkcs11.CKF_HW, "hw"},
+	{pkcs11.CKF_ENCRYPT, "encrypt"},
+	{pkcs11.CKF_DECRYPT, "decrypt"},
+	{pkcs11.CKF_DIGEST, "digest"},
+	{pkcs11.CKF_SIGN, "sign"},
+	{pkcs11.CKF_SIGN_RECOVER, "sign_recover"},
+	{pkcs11.CKF_VERIFY, "verify"},
+	{pkcs11.CKF_VERIFY_RECOVER, "verify_recover"},
+	{pkcs11.CKF_GENERATE, "generate"},
+	{pkcs11.CKF_GENERATE_KEY_PAIR, "generate_key_pair"},
+	{pkcs11.CKF_WRAP, "wrap"},
+	{pkcs11.CKF_UNWRAP, "unwrap"},
+	{pkcs11.CKF_DERIVE, "derive"},
+	{pkcs11.CKF_EC_F_P, "ec_f_p"},
+	{pkcs11.CKF_EC_F_2M, "ec_f_2m"},
+	{pkcs11.CKF_EC_ECPARAMETERS, "ec_ecparameters"},
+	{pkcs11.CKF_EC_NAMEDCURVE, "ec_namedcurve"},
+	{pkcs11.CKF_EC_UNCOMPRESS, "ec_uncompress"},
+	{pkcs11.CKF_EC_COMPRESS, "ec_compress"},
+}
@@ -0,0 +1,339 @@
+package hsm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultProviderName names the single provider built from PKCS11_LIB when
+// no providers file is configured
+const DefaultProviderName = "default"
+
+// ErrProviderNotFound is returned for a provider name that is not configured
+var ErrProviderNotFound = errors.New("PKCS#11 provider not found")
+
+// Provider is one configured PKCS#11 module
+type Provider struct {
+	Name              string            `json:"name"`
+	Library           string            `json:"library"`            // path of the PKCS#11 module
+	DefaultSlot       int               `json:"default_slot"`       // slot used when a request names none
+	PoolSize          int               `json:"pool_size"`          // maximum number of sessions per slot
+	ReconnectAttempts int               `json:"reconnect_attempts"` // tries to set up a lost session, token or module again, default 5
+	Env               map[string]string `json:"env"`                // set process-wide before loading the module, e.g. SOFTHSM2_CONF
+}
+
+// ProvidersConfig is the provider registry configuration. Default names the
+// provider used by requests that do not select one; it may be left empty
+// when only one provider is configured.
+type ProvidersConfig struct {
+	Default   string     `json:"default"`
+	Providers []Provider `json:"providers"`
+	Groups    []Group    `json:"groups"`
+}
+
+// ProviderInfo describes a configured provider
+type ProviderInfo struct {
+	Name        string `json:"name"`
+	Library     string `json:"library"`
+	DefaultSlot int    `json:"default_slot"`
+	PoolSize    int    `json:"pool_size"`
+	Default     bool   `json:"default"`
+	Loaded      bool   `json:"loaded"`
+}
+
+// registry holds the configured providers and the managers of the ones in
+// use. Modules are loaded on first use, so a provider whose library is
+// missing on this host only fails the requests that select it.
+type registry struct {
+	config    ProvidersConfig
+	providers map[string]Provider
+	managers  map[string]*Manager
+	groups    map[string]*group
+}
+
+var (
+	registryMu     sync.Mutex
+	activeRegistry *registry
+)
+
+// LoadProviders reads a JSON providers file
+func LoadProviders(path string) (ProvidersConfig, error) {
+	var cfg ProvidersConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read providers file: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse providers file %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// ProvidersFromEnv loads the providers file named by PKCS11_PROVIDERS. When
+// it is not set a single provider is built from PKCS11_LIB,
+// PKCS11_POOL_SIZE, PKCS11_DEFAULT_SLOT and PKCS11_RECONNECT_ATTEMPTS. In both cases the ProCrypt
+// configuration adds an HA group when high availability is enabled there,
+// with its HSMs mapped to slots by PROCRYPT_SLOTS.
+func ProvidersFromEnv() (ProvidersConfig, error) {
+	cfg, err := providersFromEnv()
+	if err != nil {
+		return cfg, err
+	}
+
+	path := os.Getenv("PROCRYPT_CONFIG")
+	if path == "" {
+		path = DefaultProCryptConfig
+	}
+	slots, err := ParseProCryptSlots(os.Getenv("PROCRYPT_SLOTS"))
+	if err != nil {
+		return cfg, err
+	}
+	group, err := ProCryptGroup(path, cfg.Default, slots)
+	if err != nil {
+		return cfg, err
+	}
+	if group != nil {
+		cfg.Groups = append(cfg.Groups, *group)
+	}
+	return cfg, nil
+}
+
+// providersFromEnv reads the provider list itself
+func providersFromEnv() (ProvidersConfig, error) {
+	if path := os.Getenv("PKCS11_PROVIDERS"); path != "" {
+		return LoadProviders(path)
+	}
+
+	p := Provider{Name: DefaultProviderName, Library: os.Getenv("PKCS11_LIB"), PoolSize: DefaultPoolSize}
+	if p.Library == "" {
+		return ProvidersConfig{}, fmt.Errorf("neither PKCS11_PROVIDERS nor PKCS11_LIB environment variable is set")
+	}
+	if v := os.Getenv("PKCS11_POOL_SIZE"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size <= 0 {
+			return ProvidersConfig{}, fmt.Errorf("invalid PKCS11_POOL_SIZE: %s", v)
+		}
+		p.PoolSize = size
+	}
+	if v := os.Getenv("PKCS11_DEFAULT_SLOT"); v != "" {
+		slotID, err := strconv.Atoi(v)
+		if err != nil {
+			return ProvidersConfig{}, fmt.Errorf("invalid PKCS11_DEFAULT_SLOT: %s", v)
+		}
+		p.DefaultSlot = slotID
+	}
+	if v := os.Getenv("PKCS11_RECONNECT_ATTEMPTS"); v != "" {
+		attempts, err := strconv.Atoi(v)
+		if err != nil || attempts <= 0 {
+			return ProvidersConfig{}, fmt.Errorf("invalid PKCS11_RECONNECT_ATTEMPTS: %s", v)
+		}
+		p.ReconnectAttempts = attempts
+	}
+	return ProvidersConfig{Default: p.Name, Providers: []Provider{p}}, nil
+}
+
+// newRegistry validates the configuration. Two providers may not share a
+// library: the module is loaded once per process, so finalising one would
+// break the other. Env is applied with os.Setenv and so holds for the whole
+// process, including modules loaded earlier; two providers may therefore
+// not set the same variable to different values.
+func newRegistry(cfg ProvidersConfig) (*registry, error) {
+	if len(cfg.Providers) == 0 {
+		return nil, fmt.Errorf("no PKCS#11 provider is configured")
+	}
+	if cfg.Default == "" {
+		if len(cfg.Providers) > 1 {
+			return nil, fmt.Errorf("default provider must be set when more than one provider is configured")
+		}
+		cfg.Default = cfg.Providers[0].Name
+	}
+
+	r := &registry{config: cfg, providers: map[string]Provider{}, managers: map[string]*Manager{}, groups: map[string]*group{}}
+	libraries := map[string]string{}
+	env := map[string]string{} // variable -> provider setting it
+	for _, p := range cfg.Providers {
+		switch {
+		case p.Name == "":
+			return nil, fmt.Errorf("provider name is required")
+		case p.Library == "":
+			return nil, fmt.Errorf("library of provider %s is not set", p.Name)
+		}
+		if _, ok := r.providers[p.Name]; ok {
+			return nil, fmt.Errorf("provider %s is configured twice", p.Name)
+		}
+		if other, ok := libraries[p.Library]; ok {
+			return nil, fmt.Errorf("providers %s and %s use the same library %s", other, p.Name, p.Library)
+		}
+		for k, v := range p.Env {
+			if other, ok := env[k]; ok && r.providers[other].Env[k] != v {
+				return nil, fmt.Errorf("providers %s and %s set %s to different values; env applies to the whole process", other, p.Name, k)
+			}
+			env[k] = p.Name
+		}
+		if p.PoolSize <= 0 {
+			p.PoolSize = DefaultPoolSize
+		}
+		r.providers[p.Name] = p
+		libraries[p.Library] = p.Name
+	}
+	if _, ok := r.providers[cfg.Default]; !ok {
+		return nil, fmt.Errorf("%w: default provider %s", ErrProviderNotFound, cfg.Default)
+	}
+
+	for _, g := range cfg.Groups {
+		if err := r.addGroup(g); err != nil {
+			return nil, err
+		}
+	}
+	for _, g := range r.groups {
+		go g.watch(r)
+	}
+	return r, nil
+}
+
+// Init sets up the provider registry used by Open. It is meant to be called
+// once at startup; without it the registry is built from the environment on
+// first use.
+func Init(cfg ProvidersConfig) error {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if activeRegistry != nil {
+		return fmt.Errorf("PKCS#11 provider registry is already initialised")
+	}
+	r, err := newRegistry(cfg)
+	if err != nil {
+		return err
+	}
+	activeRegistry = r
+	return nil
+}
+
+// currentRegistry returns the registry, building it from the environment
+// when Init was not called. registryMu must be held.
+func currentRegistry() (*registry, error) {
+	if activeRegistry == nil {
+		cfg, err := ProvidersFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		if activeRegistry, err = newRegistry(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return activeRegistry, nil
+}
+
+// Lookup returns the manager of a provider, loading its module on first
+// use. An empty name selects the default provider.
+func Lookup(name string) (*Manager, error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	r, err := currentRegistry()
+	if err != nil {
+		return nil, err
+	}
+	return r.manager(name)
+}
+
+// manager returns the manager of a provider, loading its module on first
+// use. registryMu must be held.
+func (r *registry) manager(name string) (*Manager, error) {
+	if name == "" {
+		name = r.config.Default
+	}
+	if m, ok := r.managers[name]; ok {
+		return m, nil
+	}
+	p, ok := r.providers[name]
+	if !ok {
+		if _, isGroup := r.groups[name]; isGroup {
+			return nil, fmt.Errorf("%s is an HA group, not a provider", name)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrProviderNotFound, name)
+	}
+	m, err := NewManager(p)
+	if err != nil {
+		return nil, err
+	}
+	r.managers[name] = m
+	return m, nil
+}
+
+// Default returns the manager of the default provider
+func Default() (*Manager, error) {
+	return Lookup("")
+}
+
+// DefaultSlot returns the slot a provider uses when a request names none.
+// HA groups choose the slot per member, so for them it is always 0.
+func DefaultSlot(name string) (int, error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	r, err := currentRegistry()
+	if err != nil {
+		return 0, err
+	}
+	if name == "" {
+		name = r.config.Default
+	}
+	if _, ok := r.groups[name]; ok {
+		return 0, nil
+	}
+	p, ok := r.providers[name]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrProviderNotFound, name)
+	}
+	return p.DefaultSlot, nil
+}
+
+// ListProviders describes every configured provider, sorted by name
+func ListProviders() ([]ProviderInfo, error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	r, err := currentRegistry()
+	if err != nil {
+		return nil, err
+	}
+	providers := make([]ProviderInfo, 0, len(r.providers))
+	for name, p := range r.providers {
+		_, loaded := r.managers[name]
+		providers = append(providers, ProviderInfo{
+			Name:        name,
+			Library:     p.Library,
+			DefaultSlot: p.DefaultSlot,
+			PoolSize:    p.PoolSize,
+			Default:     name == r.config.Default,
+			Loaded:      loaded,
+		})
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].Name < providers[j].Name })
+	return providers, nil
+}
+
+// Shutdown stops the HA health checks, closes every pooled session and
+// finalises every loaded module
+func Shutdown() {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if activeRegistry == nil {
+		return
+	}
+	for _, g := range activeRegistry.groups {
+		close(g.stop)
+	}
+	for name, m := range activeRegistry.managers {
+		m.Close()
+		delete(activeRegistry.managers, name)
+	}
+	activeRegistry = nil
+}
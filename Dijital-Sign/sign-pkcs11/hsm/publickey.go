@@ -0,0 +1,140 @@
+package hsm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ellipticCurves maps curve names to the Go implementations
+var ellipticCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// PublicKey reads the public key material of an RSA, EC or Ed25519 key object
+// and returns it as *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey.
+// Private key objects work too as long as the token exposes the public
+// components on them.
+func (s *Session) PublicKey(handle pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	v, err := s.Attribute(handle, pkcs11.CKA_KEY_TYPE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key type: %w", err)
+	}
+
+	switch keyType := Ulong(v); keyType {
+	case pkcs11.CKK_RSA:
+		modulus, err := s.Attribute(handle, pkcs11.CKA_MODULUS)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read modulus: %w", err)
+		}
+		exponent, err := s.Attribute(handle, pkcs11.CKA_PUBLIC_EXPONENT)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public exponent: %w", err)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(modulus),
+			E: int(new(big.Int).SetBytes(exponent).Int64()),
+		}, nil
+
+	case pkcs11.CKK_EC, CKK_EC_EDWARDS:
+		params, err := s.Attribute(handle, pkcs11.CKA_EC_PARAMS)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read EC parameters: %w", err)
+		}
+		curveName := CurveName(params)
+		if curveName == "" {
+			return nil, fmt.Errorf("unsupported EC parameters: %x", params)
+		}
+		point, err := s.Attribute(handle, pkcs11.CKA_EC_POINT)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read EC point: %w", err)
+		}
+		point = unwrapECPoint(point)
+
+		if curveName == "Ed25519" {
+			if len(point) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("invalid Ed25519 public key length: %d", len(point))
+			}
+			return ed25519.PublicKey(point), nil
+		}
+
+		curve := ellipticCurves[curveName]
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return nil, fmt.Errorf("invalid EC point for curve %s", curveName)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type: 0x%x", keyType)
+	}
+}
+
+// unwrapECPoint strips the DER OCTET STRING most tokens wrap CKA_EC_POINT
+// in; values that are not wrapped are returned unchanged
+func unwrapECPoint(point []byte) []byte {
+	var raw []byte
+	if rest, err := asn1.Unmarshal(point, &raw); err == nil && len(rest) == 0 {
+		return raw
+	}
+	return point
+}
+
+// PublicKeyAttributes returns the key type specific attributes describing a
+// public key (CKA_KEY_TYPE plus modulus/exponent or EC parameters/point),
+// ready to be combined with class, label and usage attributes in a
+// C_CreateObject template
+func PublicKeyAttributes(pub crypto.PublicKey) ([]*pkcs11.Attribute, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, k.N.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, big.NewInt(int64(k.E)).Bytes()),
+		}, nil
+
+	case *ecdsa.PublicKey:
+		oid, ok := CurveOIDs[k.Curve.Params().Name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported EC curve: %s", k.Curve.Params().Name)
+		}
+		params, err := asn1.Marshal(oid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode EC parameters: %w", err)
+		}
+		point, err := asn1.Marshal(elliptic.Marshal(k.Curve, k.X, k.Y))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode EC point: %w", err)
+		}
+		return []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, point),
+		}, nil
+
+	case ed25519.PublicKey:
+		params, err := asn1.Marshal(CurveOIDs["Ed25519"])
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode Ed25519 parameters: %w", err)
+		}
+		point, err := asn1.Marshal([]byte(k))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode Ed25519 public key: %w", err)
+		}
+		return []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, CKK_EC_EDWARDS),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, point),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", pub)
+}
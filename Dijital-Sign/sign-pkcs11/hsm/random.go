@@ -0,0 +1,45 @@
+package hsm
+
+import (
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// MaxRandomLength is the largest number of bytes one call may request
+const MaxRandomLength = 1024
+
+// GenerateRandom draws n bytes from the token's RNG with C_GenerateRandom on
+// a session the caller already holds
+func GenerateRandom(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, n int) ([]byte, error) {
+	if n <= 0 || n > MaxRandomLength {
+		return nil, fmt.Errorf("random length must be between 1 and %d bytes", MaxRandomLength)
+	}
+	random, err := ctx.GenerateRandom(session, n)
+	if err != nil {
+		return nil, fmt.Errorf("GenerateRandom failed: %w", err)
+	}
+	if len(random) != n {
+		return nil, fmt.Errorf("GenerateRandom returned %d bytes instead of %d", len(random), n)
+	}
+	return random, nil
+}
+
+// Random draws n bytes from the RNG of a provider's slot on a session
+// logged in with pin, so only callers that know the slot's PIN can use the
+// token's RNG. The call is repeated after a reconnect, or on another member
+// of an HA group, when the session or device is lost.
+func Random(provider string, slotID int, pin string, n int) ([]byte, error) {
+	var random []byte
+	err := Failover(provider, slotID, func(provider string, slotID int) error {
+		s, err := Open(provider, slotID, pin)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		random, err = GenerateRandom(s.Ctx, s.Handle, n)
+		return err
+	})
+	return random, err
+}
@@ -0,0 +1,265 @@
+package hsm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// DefaultReconnectAttempts is the number of reconnect attempts unless the
+// provider configures another number
+const DefaultReconnectAttempts = 5
+
+// Reconnect attempts wait reconnectBaseDelay, doubling after every failed
+// attempt up to reconnectMaxDelay
+const (
+	reconnectBaseDelay = 500 * time.Millisecond
+	reconnectMaxDelay  = 30 * time.Second
+)
+
+// ErrReconnectFailed is returned when a lost session, token or module could
+// not be set up again
+var ErrReconnectFailed = errors.New("PKCS#11 reconnect failed")
+
+// reconnectCodes are the return values after which the slot must be logged
+// in again, and possibly the module initialised again, before it is usable
+var reconnectCodes = []pkcs11.Error{
+	pkcs11.CKR_SESSION_HANDLE_INVALID,
+	pkcs11.CKR_SESSION_CLOSED,
+	pkcs11.CKR_USER_NOT_LOGGED_IN,
+	pkcs11.CKR_DEVICE_ERROR,
+	pkcs11.CKR_DEVICE_REMOVED,
+	pkcs11.CKR_TOKEN_NOT_PRESENT,
+	pkcs11.CKR_TOKEN_NOT_RECOGNIZED,
+	pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED,
+}
+
+// moduleCodes are the reconnect codes that need C_Finalize and
+// C_Initialize; for the others a new login on the slot is enough
+var moduleCodes = []pkcs11.Error{
+	pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED,
+	pkcs11.CKR_DEVICE_ERROR,
+	pkcs11.CKR_DEVICE_REMOVED,
+}
+
+// NeedsReconnect reports whether err means the session, token or module is
+// gone and the operation may succeed after Reconnect. A failed reconnect
+// does not need another one.
+func NeedsReconnect(err error) bool {
+	return !errors.Is(err, ErrReconnectFailed) && hasCode(err, reconnectCodes)
+}
+
+// hasCode reports whether err wraps one of the return values
+func hasCode(err error, codes []pkcs11.Error) bool {
+	var ckr pkcs11.Error
+	if !errors.As(err, &ckr) {
+		return false
+	}
+	for _, code := range codes {
+		if ckr == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Generation returns the number of reconnects so far. Callers read it
+// before an operation and pass it to Reconnect.
+func (m *Manager) Generation() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.generation
+}
+
+// reconnectCall is a reconnect of one slot. Callers that failed in the same
+// generation, or while it runs, wait for it and share its outcome.
+type reconnectCall struct {
+	gen  uint64
+	done chan struct{}
+	err  error
+}
+
+// Reconnect sets up a slot again after an operation failed with cause. For
+// module errors the module is finalised and initialised again, which closes
+// the pools of every slot. Attempts are repeated with exponential backoff
+// until the token answers; the slot's pool is closed only once the token
+// answers and its login is found to be gone, so a transient failure keeps
+// borrowed sessions. Every slot that had a pool is then logged in again
+// with its PIN.
+//
+// One reconnect runs per slot at a time. Callers failing in the same
+// generation, or while it runs, wait for it and get its result, so an
+// outage costs one backoff however many requests hit it. The generation
+// changes whether the reconnect succeeds or fails, so requests started
+// afterwards try again. When gen is no longer current and no reconnect of
+// the slot is pending, another caller has already reconnected and Reconnect
+// returns at once.
+func (m *Manager) Reconnect(slotID int, gen uint64, cause error) error {
+	return m.reconnect(uint(slotID), gen, cause, m.provider.ReconnectAttempts)
+}
+
+// reconnect is Reconnect with a given number of attempts
+func (m *Manager) reconnect(slotID uint, gen uint64, cause error, attempts int) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrManagerClosed
+	}
+	if call, ok := m.reconnects[slotID]; ok && (call.gen == gen || call.pending()) {
+		m.mu.Unlock()
+		<-call.done
+		return call.err
+	}
+	if m.generation != gen {
+		m.mu.Unlock()
+		return nil
+	}
+
+	call := &reconnectCall{gen: gen, done: make(chan struct{})}
+	if m.reconnects == nil {
+		m.reconnects = map[uint]*reconnectCall{}
+	}
+	m.reconnects[slotID] = call
+	pins := map[uint]string{}
+	for id, p := range m.pools {
+		pins[id] = p.pin
+	}
+	m.mu.Unlock()
+
+	call.err = m.recover(slotID, cause, attempts, pins)
+	close(call.done)
+	return call.err
+}
+
+// pending reports whether the reconnect is still running
+func (c *reconnectCall) pending() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// recover makes the reconnect attempts. m.mu is held during an attempt and
+// released while waiting for the next one.
+func (m *Manager) recover(slotID uint, cause error, attempts int, pins map[uint]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	module := hasCode(cause, moduleCodes)
+	delay := reconnectBaseDelay
+	for attempt := 1; ; attempt++ {
+		if m.closed {
+			return ErrManagerClosed
+		}
+		err := m.probe(slotID, module)
+		if err == nil {
+			break
+		}
+		if attempt >= attempts {
+			m.generation++
+			return fmt.Errorf("%w: %s slot %d after %d attempts: %w", ErrReconnectFailed, m.provider.Name, slotID, attempts, err)
+		}
+		module = module || hasCode(err, moduleCodes)
+
+		seen := m.generation
+		m.mu.Unlock()
+		time.Sleep(delay)
+		m.mu.Lock()
+		delay = min(delay*2, reconnectMaxDelay)
+		if m.generation != seen {
+			// The slot was closed or set up again meanwhile, for instance by
+			// a module reconnect of another slot; callers try again
+			return nil
+		}
+	}
+	m.generation++
+
+	// A failed login is left to the next Open, which reports it to its caller
+	for id, pin := range pins {
+		if _, ok := m.pools[id]; !ok {
+			m.newPool(id, pin)
+		}
+	}
+	return nil
+}
+
+// probe checks whether the token of a slot answers, initialising the module
+// again first when module is set. When the token answers but the slot is no
+// longer logged in, its pool is closed so that it logs in again. m.mu must
+// be held.
+func (m *Manager) probe(slotID uint, module bool) error {
+	if module {
+		if err := m.reinitialize(); err != nil {
+			return err
+		}
+	}
+	if _, err := m.ctx.GetTokenInfo(slotID); err != nil {
+		return fmt.Errorf("GetTokenInfo failed: %w", err)
+	}
+	if _, ok := m.pools[slotID]; ok && !m.loggedIn(slotID) {
+		m.closePool(slotID)
+	}
+	return nil
+}
+
+// loggedIn reports whether the user is logged in to a slot. Login state is
+// shared by the application's sessions, so a new session shows it.
+func (m *Manager) loggedIn(slotID uint) bool {
+	session, err := m.ctx.OpenSession(slotID, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return false
+	}
+	defer m.ctx.CloseSession(session)
+	info, err := m.ctx.GetSessionInfo(session)
+	if err != nil {
+		return false
+	}
+	return info.State == pkcs11.CKS_RO_USER_FUNCTIONS || info.State == pkcs11.CKS_RW_USER_FUNCTIONS
+}
+
+// reinitialize closes every pool and initialises the module again. m.mu
+// must be held.
+func (m *Manager) reinitialize() error {
+	for id := range m.pools {
+		m.closePool(id)
+	}
+	m.mechMu.Lock()
+	m.mechCache = nil
+	m.mechMu.Unlock()
+
+	m.ctx.Finalize()
+	if err := m.ctx.Initialize(); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		return fmt.Errorf("failed to initialize PKCS#11 library: %w", err)
+	}
+	return nil
+}
+
+// resetSlot closes the pool of a slot so the next Open logs in again
+func (m *Manager) resetSlot(slotID uint) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closePool(slotID)
+}
+
+// retry runs a safe operation on a provider's slot. After an error that
+// needs a reconnect, it reconnects the slot and runs the operation once
+// more.
+func retry(provider string, slotID int, op func(provider string, slotID int) error) error {
+	m, err := Lookup(provider)
+	if err != nil {
+		return err
+	}
+	gen := m.Generation()
+	err = op(provider, slotID)
+	if err == nil || !NeedsReconnect(err) {
+		return err
+	}
+	if err := m.Reconnect(slotID, gen, err); err != nil {
+		return err
+	}
+	return op(provider, slotID)
+}
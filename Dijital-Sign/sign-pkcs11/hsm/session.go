@@ -0,0 +1,89 @@
+// Package hsm holds the PKCS#11 plumbing shared by the service packages:
+// session handling, object search and attribute decoding.
+package hsm
+
+import (
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// findBatchSize is the number of handles requested per C_FindObjects call
+const findBatchSize = 64
+
+// Session is a logged-in PKCS#11 user session on a single slot
+type Session struct {
+	Ctx      *pkcs11.Ctx
+	Handle   pkcs11.SessionHandle
+	SlotID   int
+	Provider string
+
+	pool *pool
+}
+
+// Open borrows a logged-in read/write session on the slot of a provider; an
+// empty provider name selects the default one. For an HA group the session
+// comes from the primary member and slotID is ignored. Close must be called
+// when done.
+func Open(provider string, slotID int, pin string) (*Session, error) {
+	g, err := lookupGroup(provider)
+	if err != nil {
+		return nil, err
+	}
+	if g != nil {
+		return g.open(pin)
+	}
+	m, err := Lookup(provider)
+	if err != nil {
+		return nil, err
+	}
+	return m.Open(slotID, pin)
+}
+
+// Close returns a pooled session to its pool. Sessions built by hand around
+// another session's handle are left to their owner.
+func (s *Session) Close() {
+	if s.pool != nil {
+		s.pool.put(s.Handle)
+		s.pool = nil
+	}
+}
+
+// FindObjects returns every object matching the template, calling
+// C_FindObjects until the token reports no more matches
+func (s *Session) FindObjects(template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+	if err := s.Ctx.FindObjectsInit(s.Handle, template); err != nil {
+		return nil, fmt.Errorf("FindObjectsInit failed: %w", err)
+	}
+
+	var handles []pkcs11.ObjectHandle
+	for {
+		objs, _, err := s.Ctx.FindObjects(s.Handle, findBatchSize)
+		if err != nil {
+			s.Ctx.FindObjectsFinal(s.Handle)
+			return nil, fmt.Errorf("FindObjects failed: %w", err)
+		}
+		if len(objs) == 0 {
+			break
+		}
+		handles = append(handles, objs...)
+	}
+
+	if err := s.Ctx.FindObjectsFinal(s.Handle); err != nil {
+		return nil, fmt.Errorf("FindObjectsFinal failed: %w", err)
+	}
+	return handles, nil
+}
+
+// Attribute reads a single attribute of an object. Attributes are read one
+// at a time because tokens reject the whole C_GetAttributeValue call when any
+// requested type is invalid for the object class.
+func (s *Session) Attribute(handle pkcs11.ObjectHandle, typ uint) ([]byte, error) {
+	attrs, err := s.Ctx.GetAttributeValue(s.Handle, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(typ, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attrs[0].Value, nil
+}
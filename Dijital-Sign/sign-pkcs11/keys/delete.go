@@ -0,0 +1,194 @@
+package keys
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sign-pkcs11/blockchain"
+	"sign-pkcs11/hsm"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+var (
+	// ErrKeyNotFound is returned when no key matches the requested label or ID
+	ErrKeyNotFound = errors.New("no key found for the given label/ID")
+	// ErrKeyReferenced is returned when the ledger still references the key
+	ErrKeyReferenced = errors.New("key is referenced by ledger entries")
+	// ErrKeyAmbiguous is returned when a label or CKA_ID matches more than
+	// one public or more than one private key
+	ErrKeyAmbiguous = errors.New("label/ID matches more than one key pair")
+)
+
+// DeleteResult describes the objects removed (or, for a dry run, the objects
+// that would be removed) by DeleteKeyPair
+type DeleteResult struct {
+	DryRun           bool      `json:"dry_run"`
+	Objects          []KeyInfo `json:"objects"`
+	LedgerReferences int       `json:"ledger_references"`
+}
+
+// BaseLabel strips the "_pub"/"_priv" suffix GenerateRSAKey appends to labels
+func BaseLabel(label string) string {
+	for _, suffix := range []string{"_pub", "_priv"} {
+		if strings.HasSuffix(label, suffix) {
+			return strings.TrimSuffix(label, suffix)
+		}
+	}
+	return label
+}
+
+// pairLabels returns the labels a key pair created under the given label may carry
+func pairLabels(label string) []string {
+	base := BaseLabel(label)
+	return []string{base, base + "_pub", base + "_priv"}
+}
+
+// DeleteKeyPair locates a key pair by label and/or CKA_ID and destroys both
+// the public and private objects. Keys whose labels are referenced by
+// ledger entries are only removed when force is set. When the label or ID
+// matches more than one pair, nothing is destroyed and ErrKeyAmbiguous is
+// returned with a result listing every match. When an object cannot be
+// destroyed, the result listing the objects destroyed so far is returned
+// with the error.
+func DeleteKeyPair(provider string, slotID int, userPin string, keyLabel string, keyIDHex string, dryRun bool, force bool, bc *blockchain.Blockchain) (*DeleteResult, error) {
+	if keyLabel == "" && keyIDHex == "" {
+		return nil, fmt.Errorf("%w: KeyLabel or KeyId is required", hsm.ErrInvalidRequest)
+	}
+	keyID, err := hex.DecodeString(keyIDHex)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid KeyId: %w", hsm.ErrInvalidRequest, err)
+	}
+
+	s, err := hsm.Open(provider, slotID, userPin)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	handles, err := findPair(s, keyLabel, keyID)
+	if errors.Is(err, ErrKeyAmbiguous) {
+		result := &DeleteResult{DryRun: dryRun, Objects: []KeyInfo{}}
+		for _, handle := range handles {
+			result.Objects = append(result.Objects, describe(s, handle))
+		}
+		return result, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(handles) == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	result := &DeleteResult{DryRun: dryRun, Objects: []KeyInfo{}}
+	var labels []string
+	for _, handle := range handles {
+		info := describe(s, handle)
+		result.Objects = append(result.Objects, info)
+		if info.Label != "" {
+			labels = append(labels, pairLabels(info.Label)...)
+		}
+	}
+	if keyLabel != "" {
+		labels = append(labels, pairLabels(keyLabel)...)
+	}
+
+	if bc != nil {
+		result.LedgerReferences = len(bc.KeyReferences(labels...))
+	}
+	if result.LedgerReferences > 0 && !force {
+		return result, fmt.Errorf("%w: %d block(s), pass Force to delete anyway", ErrKeyReferenced, result.LedgerReferences)
+	}
+
+	if dryRun {
+		return result, nil
+	}
+
+	// On failure the result lists only the objects already destroyed
+	planned := result.Objects
+	result.Objects = []KeyInfo{}
+	for i, handle := range handles {
+		if err := s.Ctx.DestroyObject(s.Handle, handle); err != nil {
+			return result, fmt.Errorf("failed to destroy object %d after destroying %d of %d: %w", handle, i, len(handles), err)
+		}
+		result.Objects = append(result.Objects, planned[i])
+	}
+	return result, nil
+}
+
+// findPair returns the public and private key objects matching the label
+// (with or without the "_pub"/"_priv" suffix) and/or the CKA_ID. When only
+// one half of a pair matches by label, its partner is looked up by CKA_ID.
+// At most one public and one private key may match; otherwise every match
+// is returned with ErrKeyAmbiguous.
+func findPair(s *hsm.Session, keyLabel string, keyID []byte) ([]pkcs11.ObjectHandle, error) {
+	byClass := map[uint][]pkcs11.ObjectHandle{}
+	find := func(class uint, template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+		return s.FindObjects(append([]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}, template...))
+	}
+
+	for _, class := range []uint{pkcs11.CKO_PUBLIC_KEY, pkcs11.CKO_PRIVATE_KEY} {
+		if keyLabel == "" {
+			found, err := find(class, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, keyID)})
+			if err != nil {
+				return nil, err
+			}
+			byClass[class] = found
+			continue
+		}
+
+		candidates := []string{keyLabel}
+		if BaseLabel(keyLabel) == keyLabel {
+			candidates = append(candidates, keyLabel+"_pub", keyLabel+"_priv")
+		} else {
+			candidates = pairLabels(keyLabel)[1:]
+		}
+		for _, label := range candidates {
+			template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, label)}
+			if len(keyID) > 0 {
+				template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, keyID))
+			}
+			found, err := find(class, template)
+			if err != nil {
+				return nil, err
+			}
+			byClass[class] = append(byClass[class], found...)
+		}
+	}
+
+	// Complete a half pair through the CKA_ID, but only when the partner is
+	// unambiguous: keys created before unique IDs all share the same CKA_ID.
+	pub, priv := byClass[pkcs11.CKO_PUBLIC_KEY], byClass[pkcs11.CKO_PRIVATE_KEY]
+	if keyLabel != "" && (len(pub) == 0) != (len(priv) == 0) {
+		have, missing := pub, uint(pkcs11.CKO_PRIVATE_KEY)
+		if len(pub) == 0 {
+			have, missing = priv, pkcs11.CKO_PUBLIC_KEY
+		}
+		if len(have) == 1 {
+			if id, err := s.Attribute(have[0], pkcs11.CKA_ID); err == nil && len(id) > 0 {
+				found, err := find(missing, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, id)})
+				if err != nil {
+					return nil, err
+				}
+				if len(found) == 1 {
+					byClass[missing] = found
+				}
+			}
+		}
+	}
+
+	pub, priv = byClass[pkcs11.CKO_PUBLIC_KEY], byClass[pkcs11.CKO_PRIVATE_KEY]
+	return append(pub, priv...), checkPair(len(pub), len(priv))
+}
+
+// checkPair rejects matches of more than one public or private key. Keys
+// created before unique IDs all share the CKA_ID 01020304, and labels need
+// not be unique, so a broad match must not remove several pairs at once.
+func checkPair(pub, priv int) error {
+	if pub > 1 || priv > 1 {
+		return fmt.Errorf("%w: %d public and %d private keys match; narrow the selection with both KeyLabel and KeyId", ErrKeyAmbiguous, pub, priv)
+	}
+	return nil
+}
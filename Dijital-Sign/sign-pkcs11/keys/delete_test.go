@@ -0,0 +1,29 @@
+package keys
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckPair(t *testing.T) {
+	tests := []struct {
+		name      string
+		pub, priv int
+		ambiguous bool
+	}{
+		{"pair", 1, 1, false},
+		{"public half", 1, 0, false},
+		{"private half", 0, 1, false},
+		{"nothing", 0, 0, false},
+		// Every legacy key shares the CKA_ID 01020304
+		{"ambiguous ID", 3, 3, true},
+		{"duplicate label", 2, 1, true},
+		{"duplicate private label", 1, 2, true},
+	}
+	for _, tt := range tests {
+		err := checkPair(tt.pub, tt.priv)
+		if errors.Is(err, ErrKeyAmbiguous) != tt.ambiguous {
+			t.Errorf("%s: checkPair(%d, %d) = %v, ambiguous %v", tt.name, tt.pub, tt.priv, err, tt.ambiguous)
+		}
+	}
+}
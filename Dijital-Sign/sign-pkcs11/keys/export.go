@@ -0,0 +1,206 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sign-pkcs11/hsm"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Export formats accepted by ExportPublicKey
+const (
+	FormatPEM = "pem"
+	FormatDER = "der"
+	FormatJWK = "jwk"
+)
+
+// ExportResult holds an exported public key. Only the field matching the
+// requested format is set; the fingerprints are always present.
+type ExportResult struct {
+	Label             string          `json:"label"`
+	KeyID             string          `json:"key_id"`
+	Format            string          `json:"format"`
+	PEM               string          `json:"pem,omitempty"`
+	DER               string          `json:"der,omitempty"`
+	JWK               json.RawMessage `json:"jwk,omitempty"`
+	FingerprintSHA256 string          `json:"fingerprint_sha256"`
+	JWKThumbprint     string          `json:"jwk_thumbprint"`
+}
+
+// ExportPublicKey reads the public key object matching the label and/or
+// CKA_ID and returns its SubjectPublicKeyInfo as PEM, base64 DER or JWK,
+// along with the SHA-256 fingerprint of the DER encoding and the RFC 7638
+// JWK thumbprint. The read is repeated after a reconnect, or on another
+// member of an HA group, when the session or device is lost.
+func ExportPublicKey(provider string, slotID int, userPin string, keyLabel string, keyIDHex string, format string) (*ExportResult, error) {
+	if format == "" {
+		format = FormatPEM
+	}
+	if format != FormatPEM && format != FormatDER && format != FormatJWK {
+		return nil, fmt.Errorf("%w: unsupported export format: %s (supported: pem, der, jwk)", hsm.ErrInvalidRequest, format)
+	}
+	keyID, err := hex.DecodeString(keyIDHex)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid KeyId: %w", hsm.ErrInvalidRequest, err)
+	}
+
+	var result *ExportResult
+	err = hsm.Failover(provider, slotID, func(provider string, slotID int) (err error) {
+		result, err = exportPublicKey(provider, slotID, userPin, keyLabel, keyID, format)
+		return err
+	})
+	return result, err
+}
+
+// exportPublicKey is ExportPublicKey on a single slot
+func exportPublicKey(provider string, slotID int, userPin string, keyLabel string, keyID []byte, format string) (*ExportResult, error) {
+	s, err := hsm.Open(provider, slotID, userPin)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	handle, err := findPublicKey(s, keyLabel, keyID)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := s.PublicKey(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %w", err)
+	}
+	jwk, err := publicJWK(pub)
+	if err != nil {
+		return nil, err
+	}
+	thumbprint, err := jwkThumbprint(jwk)
+	if err != nil {
+		return nil, err
+	}
+
+	info := describe(s, handle)
+	fingerprint := sha256.Sum256(der)
+	result := &ExportResult{
+		Label:             info.Label,
+		KeyID:             info.ID,
+		Format:            format,
+		FingerprintSHA256: hex.EncodeToString(fingerprint[:]),
+		JWKThumbprint:     thumbprint,
+	}
+
+	switch format {
+	case FormatPEM:
+		result.PEM = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	case FormatDER:
+		result.DER = base64.StdEncoding.EncodeToString(der)
+	case FormatJWK:
+		jwk["kid"] = thumbprint
+		result.JWK, err = json.Marshal(jwk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode JWK: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// findPublicKey returns the public key object for a label and/or CKA_ID.
+// Besides the exact label, the "_pub" label of the pair is tried, so either
+// the base label or the "_priv" label of a generated key pair can be given.
+func findPublicKey(s *hsm.Session, keyLabel string, keyID []byte) (pkcs11.ObjectHandle, error) {
+	if keyLabel == "" && len(keyID) == 0 {
+		return 0, fmt.Errorf("%w: KeyLabel or KeyId is required", hsm.ErrInvalidRequest)
+	}
+
+	var labels []string
+	if keyLabel != "" {
+		labels = []string{keyLabel}
+		if pubLabel := BaseLabel(keyLabel) + "_pub"; pubLabel != keyLabel {
+			labels = append(labels, pubLabel)
+		}
+	} else {
+		labels = []string{""}
+	}
+
+	for _, label := range labels {
+		template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY)}
+		if label != "" {
+			template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, label))
+		}
+		if len(keyID) > 0 {
+			template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, keyID))
+		}
+		handles, err := s.FindObjects(template)
+		if err != nil {
+			return 0, err
+		}
+		if len(handles) > 0 {
+			return handles[0], nil
+		}
+	}
+	return 0, ErrKeyNotFound
+}
+
+// publicJWK returns the JWK members (RFC 7517/7518/8037) of a public key
+func publicJWK(pub crypto.PublicKey) (map[string]string, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA",
+			"n":   b64(k.N.Bytes()),
+			"e":   b64(big.NewInt(int64(k.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return map[string]string{
+			"kty": "EC",
+			"crv": k.Curve.Params().Name,
+			"x":   b64(k.X.FillBytes(make([]byte, size))),
+			"y":   b64(k.Y.FillBytes(make([]byte, size))),
+		}, nil
+	case ed25519.PublicKey:
+		return map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   b64(k),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", pub)
+}
+
+// jwkThumbprint computes the RFC 7638 SHA-256 thumbprint over the required
+// members of the JWK. encoding/json sorts map keys, which yields the
+// lexicographic member order the RFC requires.
+func jwkThumbprint(jwk map[string]string) (string, error) {
+	required := map[string][]string{
+		"RSA": {"e", "kty", "n"},
+		"EC":  {"crv", "kty", "x", "y"},
+		"OKP": {"crv", "kty", "x"},
+	}[jwk["kty"]]
+
+	members := make(map[string]string, len(required))
+	for _, name := range required {
+		members[name] = jwk[name]
+	}
+	canonical, err := json.Marshal(members)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode JWK thumbprint input: %w", err)
+	}
+	sum := sha256.Sum256(canonical)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
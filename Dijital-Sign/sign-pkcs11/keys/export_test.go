@@ -0,0 +1,74 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"testing"
+)
+
+// Test vectors from RFC 7638, section 3.1, and RFC 8037, appendix A.3
+const (
+	rfc7638N          = "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw"
+	rfc7638Thumbprint = "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"
+	rfc8037X          = "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"
+	rfc8037Thumbprint = "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k"
+)
+
+func TestJWKThumbprint(t *testing.T) {
+	tests := []struct {
+		name string
+		jwk  map[string]string
+		want string
+	}{
+		{"RFC 7638 RSA", map[string]string{"kty": "RSA", "n": rfc7638N, "e": "AQAB"}, rfc7638Thumbprint},
+		{"optional members ignored", map[string]string{"kty": "RSA", "n": rfc7638N, "e": "AQAB", "alg": "RS256", "kid": "2011-04-29"}, rfc7638Thumbprint},
+		{"RFC 8037 Ed25519", map[string]string{"kty": "OKP", "crv": "Ed25519", "x": rfc8037X}, rfc8037Thumbprint},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := jwkThumbprint(tt.jwk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("jwkThumbprint = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublicJWKThumbprint(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	tests := []struct {
+		name string
+		pub  crypto.PublicKey
+		want string
+	}{
+		{"RSA", &rsa.PublicKey{N: new(big.Int).SetBytes(decode(rfc7638N)), E: 65537}, rfc7638Thumbprint},
+		{"Ed25519", ed25519.PublicKey(decode(rfc8037X)), rfc8037Thumbprint},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jwk, err := publicJWK(tt.pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := jwkThumbprint(jwk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("thumbprint = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package keys
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sign-pkcs11/create"
+	"sign-pkcs11/hsm"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// integration returns the default slot and user PIN of a real token, for
+// instance SoftHSM:
+//
+//	PKCS11_LIB=/usr/lib/softhsm/libsofthsm2.so PKCS11_PIN=1234 go test ./keys
+//
+// The token in PKCS11_DEFAULT_SLOT (default 0) must be initialised with the
+// user PIN PKCS11_PIN. The test is skipped when PKCS11_LIB is not set.
+func integration(t *testing.T) (int, string) {
+	t.Helper()
+	if os.Getenv("PKCS11_LIB") == "" {
+		t.Skip("PKCS11_LIB is not set")
+	}
+	pin := os.Getenv("PKCS11_PIN")
+	if pin == "" {
+		t.Fatal("PKCS11_PIN must be set with PKCS11_LIB")
+	}
+	t.Cleanup(hsm.Shutdown)
+
+	slotID, err := hsm.DefaultSlot("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return slotID, pin
+}
+
+func TestRotateIntegration(t *testing.T) {
+	slotID, pin := integration(t)
+	base := fmt.Sprintf("itest-%d", time.Now().UnixNano())
+	if _, err := create.GenerateRSAKey("", slotID, pin, 2048, base, "", ""); err != nil {
+		t.Fatalf("GenerateRSAKey: %v", err)
+	}
+	t.Cleanup(func() {
+		for _, label := range []string{base, VersionLabel(base, 1)} {
+			if _, err := DeleteKeyPair("", slotID, pin, label, "", false, true, nil); err != nil {
+				t.Errorf("DeleteKeyPair(%s): %v", label, err)
+			}
+		}
+	})
+
+	if _, err := RotateKey("", slotID, pin, base, "encryption-only", nil); err == nil {
+		t.Error("RotateKey accepted a profile that cannot sign")
+	}
+	result, err := RotateKey("", slotID, pin, base, "", nil)
+	if err != nil {
+		t.Fatalf("RotateKey: %v", err)
+	}
+	if result.Version != 1 || result.ActiveLabel != base+"-v1_priv" {
+		t.Errorf("RotateKey = version %d, active %s", result.Version, result.ActiveLabel)
+	}
+	if len(result.Demoted) != 1 || result.Demoted[0] != base+"_priv" {
+		t.Errorf("Demoted = %v, want [%s_priv]", result.Demoted, base)
+	}
+
+	s, err := hsm.Open("", slotID, pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	versions, err := Versions(s, base, pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		t.Fatalf("Versions: %v", err)
+	}
+	var got []string
+	for _, v := range versions {
+		got = append(got, fmt.Sprintf("%d:%s", v.Version, v.Label))
+	}
+	want := []string{"1:" + base + "-v1_priv", "0:" + base + "_priv"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Versions = %v, want %v", got, want)
+	}
+
+	active, err := ActiveVersion(s, base)
+	if err != nil {
+		t.Fatalf("ActiveVersion: %v", err)
+	}
+	if active.Version != 1 {
+		t.Errorf("ActiveVersion = %d, want 1", active.Version)
+	}
+}
+
+// TestDeleteAmbiguousIntegration creates two pairs with the same label and,
+// like keys created before unique IDs, the same CKA_ID, and checks that
+// neither the label nor the ID deletes them
+func TestDeleteAmbiguousIntegration(t *testing.T) {
+	slotID, pin := integration(t)
+
+	label := fmt.Sprintf("itest-%d", time.Now().UnixNano())
+	for i := 0; i < 2; i++ {
+		if _, err := create.GenerateRSAKey("", slotID, pin, 2048, label, "", ""); err != nil {
+			t.Fatalf("GenerateRSAKey: %v", err)
+		}
+	}
+
+	s, err := hsm.Open("", slotID, pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var handles []pkcs11.ObjectHandle
+	for _, l := range []string{label + "_pub", label + "_priv"} {
+		found, err := s.FindObjects([]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, l)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		handles = append(handles, found...)
+	}
+	t.Cleanup(func() {
+		s, err := hsm.Open("", slotID, pin)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer s.Close()
+		for _, handle := range handles {
+			s.Ctx.DestroyObject(s.Handle, handle)
+		}
+	})
+	if len(handles) != 4 {
+		t.Fatalf("found %d objects, want 4", len(handles))
+	}
+	sharedID := []byte(label)
+	for _, handle := range handles {
+		if err := s.Ctx.SetAttributeValue(s.Handle, handle, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, sharedID)}); err != nil {
+			t.Fatalf("SetAttributeValue(CKA_ID): %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		keyLabel string
+		keyID    string
+	}{
+		{"ambiguous label", label, ""},
+		{"ambiguous private label", label + "_priv", ""},
+		{"ambiguous ID", "", hex.EncodeToString(sharedID)},
+	}
+	for _, tt := range tests {
+		result, err := DeleteKeyPair("", slotID, pin, tt.keyLabel, tt.keyID, false, true, nil)
+		if !errors.Is(err, ErrKeyAmbiguous) {
+			t.Errorf("%s: DeleteKeyPair error = %v, want ErrKeyAmbiguous", tt.name, err)
+			continue
+		}
+		if result == nil || len(result.Objects) != 4 {
+			t.Errorf("%s: result = %+v, want the 4 matches", tt.name, result)
+		}
+	}
+
+	remaining, err := s.FindObjects([]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, sharedID)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 4 {
+		t.Errorf("%d of 4 objects left after ambiguous deletes", len(remaining))
+	}
+}
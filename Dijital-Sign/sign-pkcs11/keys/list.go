@@ -0,0 +1,165 @@
+// Package keys provides inventory and lifecycle operations on objects
+// already stored on the token.
+package keys
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sign-pkcs11/hsm"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+// KeyInfo describes a single object found on the token
+type KeyInfo struct {
+	Handle      pkcs11.ObjectHandle `json:"handle"`
+	Class       string              `json:"class"`
+	KeyType     string              `json:"key_type,omitempty"`
+	Label       string              `json:"label"`
+	ID          string              `json:"id"`
+	ModulusBits int                 `json:"modulus_bits,omitempty"`
+	Curve       string              `json:"curve,omitempty"`
+	Usage       []string            `json:"usage"`
+	Flags       []string            `json:"flags"`
+}
+
+// ListFilter restricts the objects returned by ListKeys
+type ListFilter struct {
+	Class       string // "private", "public", "secret", "certificate", "data"; empty for all
+	LabelPrefix string
+}
+
+// usageAttributes are reported in KeyInfo.Usage when set to true
+var usageAttributes = []struct {
+	typ  uint
+	name string
+}{
+	{pkcs11.CKA_SIGN, "sign"},
+	{pkcs11.CKA_VERIFY, "verify"},
+	{pkcs11.CKA_ENCRYPT, "encrypt"},
+	{pkcs11.CKA_DECRYPT, "decrypt"},
+	{pkcs11.CKA_WRAP, "wrap"},
+	{pkcs11.CKA_UNWRAP, "unwrap"},
+	{pkcs11.CKA_DERIVE, "derive"},
+}
+
+// flagAttributes are reported in KeyInfo.Flags when set to true
+var flagAttributes = []struct {
+	typ  uint
+	name string
+}{
+	{pkcs11.CKA_TOKEN, "token"},
+	{pkcs11.CKA_PRIVATE, "private"},
+	{pkcs11.CKA_SENSITIVE, "sensitive"},
+	{pkcs11.CKA_EXTRACTABLE, "extractable"},
+	{pkcs11.CKA_MODIFIABLE, "modifiable"},
+}
+
+// classByName returns the object class for an API class name
+func classByName(name string) (uint, error) {
+	for class, n := range hsm.ClassNames {
+		if n == name {
+			return class, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown object class: %s (supported: private, public, secret, certificate, data)", name)
+}
+
+// ListKeys enumerates the objects on the slot and returns their attributes.
+// The read is repeated after a reconnect, or on another member of an HA
+// group, when the session or device is lost.
+func ListKeys(provider string, slotID int, userPin string, filter ListFilter) ([]KeyInfo, error) {
+	var result []KeyInfo
+	err := hsm.Failover(provider, slotID, func(provider string, slotID int) (err error) {
+		result, err = listKeys(provider, slotID, userPin, filter)
+		return err
+	})
+	return result, err
+}
+
+// listKeys is ListKeys on a single slot
+func listKeys(provider string, slotID int, userPin string, filter ListFilter) ([]KeyInfo, error) {
+	var template []*pkcs11.Attribute
+	if filter.Class != "" {
+		class, err := classByName(filter.Class)
+		if err != nil {
+			return nil, err
+		}
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_CLASS, class))
+	}
+
+	s, err := hsm.Open(provider, slotID, userPin)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	handles, err := s.FindObjects(template)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []KeyInfo{}
+	for _, handle := range handles {
+		info := describe(s, handle)
+		if !strings.HasPrefix(info.Label, filter.LabelPrefix) {
+			continue
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+// describe reads the attributes of a single object. Attributes the token
+// does not expose for the object are simply left empty.
+func describe(s *hsm.Session, handle pkcs11.ObjectHandle) KeyInfo {
+	info := KeyInfo{Handle: handle, Usage: []string{}, Flags: []string{}}
+
+	class := ^uint(0)
+	if v, err := s.Attribute(handle, pkcs11.CKA_CLASS); err == nil {
+		class = hsm.Ulong(v)
+		info.Class = hsm.ClassNames[class]
+	}
+	if v, err := s.Attribute(handle, pkcs11.CKA_LABEL); err == nil {
+		info.Label = string(v)
+	}
+	if v, err := s.Attribute(handle, pkcs11.CKA_ID); err == nil {
+		info.ID = hex.EncodeToString(v)
+	}
+	if class != pkcs11.CKO_PUBLIC_KEY && class != pkcs11.CKO_PRIVATE_KEY && class != pkcs11.CKO_SECRET_KEY {
+		return info
+	}
+
+	keyType := ^uint(0)
+	if v, err := s.Attribute(handle, pkcs11.CKA_KEY_TYPE); err == nil {
+		keyType = hsm.Ulong(v)
+		info.KeyType = hsm.KeyTypeNames[keyType]
+	}
+
+	switch keyType {
+	case pkcs11.CKK_RSA:
+		if v, err := s.Attribute(handle, pkcs11.CKA_MODULUS_BITS); err == nil {
+			info.ModulusBits = int(hsm.Ulong(v))
+		} else if v, err := s.Attribute(handle, pkcs11.CKA_MODULUS); err == nil {
+			// Private keys usually expose the modulus but not CKA_MODULUS_BITS
+			info.ModulusBits = len(v) * 8
+		}
+	case pkcs11.CKK_EC, hsm.CKK_EC_EDWARDS:
+		if v, err := s.Attribute(handle, pkcs11.CKA_EC_PARAMS); err == nil {
+			info.Curve = hsm.CurveName(v)
+		}
+	}
+
+	for _, a := range usageAttributes {
+		if v, err := s.Attribute(handle, a.typ); err == nil && hsm.Bool(v) {
+			info.Usage = append(info.Usage, a.name)
+		}
+	}
+	for _, a := range flagAttributes {
+		if v, err := s.Attribute(handle, a.typ); err == nil && hsm.Bool(v) {
+			info.Flags = append(info.Flags, a.name)
+		}
+	}
+	return info
+}
@@ -0,0 +1,237 @@
+package keys
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sign-pkcs11/blockchain"
+	"sign-pkcs11/create"
+	"sign-pkcs11/hsm"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// VersionedKey is one version of a rotated key. The un-versioned pair created
+// by the create package (<base>_pub/<base>_priv) counts as version 0.
+type VersionedKey struct {
+	Version int                 `json:"version"`
+	Label   string              `json:"label"`
+	Handle  pkcs11.ObjectHandle `json:"handle"`
+}
+
+// RotationResult describes the outcome of RotateKey
+type RotationResult struct {
+	BaseLabel   string   `json:"base_label"`
+	ActiveLabel string   `json:"active_label"`
+	Version     int      `json:"version"`
+	Demoted     []string `json:"demoted"`
+	KeyPair     string   `json:"key_pair"`
+}
+
+// VersionLabel returns the pair label of the given version of a base label
+func VersionLabel(base string, version int) string {
+	if version == 0 {
+		return base
+	}
+	return fmt.Sprintf("%s-v%d", base, version)
+}
+
+// parseVersion returns the version encoded in a pair label, or false when the
+// label does not belong to the base label
+func parseVersion(base, pairLabel string) (int, bool) {
+	if pairLabel == base {
+		return 0, true
+	}
+	suffix, ok := strings.CutPrefix(pairLabel, base+"-v")
+	if !ok {
+		return 0, false
+	}
+	version, err := strconv.Atoi(suffix)
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// Versions returns the key objects of the class belonging to every version
+// of the base label, newest first
+func Versions(s *hsm.Session, base string, class uint) ([]VersionedKey, error) {
+	suffix := "_pub"
+	if class == pkcs11.CKO_PRIVATE_KEY {
+		suffix = "_priv"
+	}
+
+	handles, err := s.FindObjects([]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)})
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []VersionedKey
+	for _, handle := range handles {
+		v, err := s.Attribute(handle, pkcs11.CKA_LABEL)
+		if err != nil {
+			continue
+		}
+		pairLabel, ok := strings.CutSuffix(string(v), suffix)
+		if !ok {
+			continue
+		}
+		if version, ok := parseVersion(base, pairLabel); ok {
+			versions = append(versions, VersionedKey{Version: version, Label: string(v), Handle: handle})
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version > versions[j].Version })
+	return versions, nil
+}
+
+// ActiveVersion returns the newest private key version of the base label
+// that is still allowed to sign
+func ActiveVersion(s *hsm.Session, base string) (*VersionedKey, error) {
+	versions, err := Versions(s, base, pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		if sign, err := s.Attribute(v.Handle, pkcs11.CKA_SIGN); err == nil && hsm.Bool(sign) {
+			return &v, nil
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+// RotateKey creates the next <base>-v<N> key pair with the same algorithm and
+// size as the current newest version, turns every older private key into a
+// verify-only key (CKA_SIGN=false) and records the rotation in the ledger.
+// The profile must allow signing, since the new version replaces a signing
+// key. When an older version cannot be made verify-only, the versions
+// already demoted may sign again and the new pair is destroyed, so the
+// previous version stays active.
+func RotateKey(provider string, slotID int, userPin string, baseLabel string, profile string, bc *blockchain.Blockchain) (*RotationResult, error) {
+	base := BaseLabel(baseLabel)
+	if base == "" {
+		return nil, fmt.Errorf("KeyLabel is required")
+	}
+	if _, err := create.SigningProfile(profile); err != nil {
+		return nil, err
+	}
+
+	// Inspect the current versions; the session is given back before the new
+	// key is generated since the create package borrows its own
+	s, err := hsm.Open(provider, slotID, userPin)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := Versions(s, base, pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if len(versions) == 0 {
+		s.Close()
+		return nil, ErrKeyNotFound
+	}
+	latest := describe(s, versions[0].Handle)
+	s.Close()
+
+	next := versions[0].Version + 1
+	newLabel := VersionLabel(base, next)
+
+	var keyPair string
+	switch latest.KeyType {
+	case "RSA":
+		keyPair, err = create.GenerateRSAKey(provider, slotID, userPin, latest.ModulusBits, newLabel, "", profile)
+	case "EC":
+		keyPair, err = create.GenerateECKey(provider, slotID, userPin, latest.Curve, newLabel, "", profile)
+	case "EC_EDWARDS":
+		keyPair, err = create.GenerateEd25519Key(provider, slotID, userPin, newLabel, "", profile)
+	default:
+		return nil, fmt.Errorf("rotation is not supported for key type %q", latest.KeyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RotationResult{
+		BaseLabel:   base,
+		ActiveLabel: newLabel + "_priv",
+		Version:     next,
+		Demoted:     []string{},
+		KeyPair:     keyPair,
+	}
+
+	s, err = hsm.Open(provider, slotID, userPin)
+	if err != nil {
+		return result, err
+	}
+	defer s.Close()
+
+	for _, v := range versions {
+		if sign, err := s.Attribute(v.Handle, pkcs11.CKA_SIGN); err == nil && !hsm.Bool(sign) {
+			continue
+		}
+		err := setSign(s, v.Handle, false)
+		if err != nil {
+			err = fmt.Errorf("failed to make %s verify-only: %w", v.Label, err)
+			if rerr := rollbackRotation(s, versions, result); rerr != nil {
+				return result, errors.Join(err, rerr)
+			}
+			return nil, fmt.Errorf("%w; rotation to %s rolled back", err, newLabel)
+		}
+		result.Demoted = append(result.Demoted, v.Label)
+	}
+
+	if bc != nil {
+		event, err := json.Marshal(map[string]interface{}{
+			"event":        "key-rotation",
+			"base_label":   base,
+			"active_label": result.ActiveLabel,
+			"version":      next,
+			"demoted":      result.Demoted,
+			"provider":     s.Provider,
+			"slot_id":      slotID,
+			"time":         time.Now().UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			return result, fmt.Errorf("failed to encode rotation event: %w", err)
+		}
+		bc.AddKeyBlock(string(event), "", base)
+	}
+	return result, nil
+}
+
+// setSign sets CKA_SIGN on a private key
+func setSign(s *hsm.Session, handle pkcs11.ObjectHandle, sign bool) error {
+	return s.Ctx.SetAttributeValue(s.Handle, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, sign),
+	})
+}
+
+// rollbackRotation lets the versions demoted so far sign again and destroys
+// the key pair created by the rotation
+func rollbackRotation(s *hsm.Session, versions []VersionedKey, result *RotationResult) error {
+	var errs []error
+	for _, v := range versions {
+		if slices.Contains(result.Demoted, v.Label) {
+			if err := setSign(s, v.Handle, true); err != nil {
+				errs = append(errs, fmt.Errorf("failed to restore signing on %s: %w", v.Label, err))
+			}
+		}
+	}
+
+	handles, err := findPair(s, VersionLabel(result.BaseLabel, result.Version), nil)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to find the new key pair: %w", err))
+		handles = nil
+	}
+	for _, handle := range handles {
+		if err := s.Ctx.DestroyObject(s.Handle, handle); err != nil {
+			errs = append(errs, fmt.Errorf("failed to destroy object %d of the new key pair: %w", handle, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,67 @@
+package keys
+
+import "testing"
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		pairLabel string
+		version   int
+		ok        bool
+	}{
+		{"signer", 0, true},
+		{"signer-v1", 1, true},
+		{"signer-v12", 12, true},
+		{"signer-v0", 0, false},
+		{"signer-v-1", 0, false},
+		{"signer-v", 0, false},
+		{"signer-vx", 0, false},
+		{"signer-v1-v2", 0, false},
+		{"signer2", 0, false},
+		{"other-v1", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		version, ok := parseVersion("signer", tt.pairLabel)
+		if version != tt.version || ok != tt.ok {
+			t.Errorf("parseVersion(%q) = %d, %v, want %d, %v", tt.pairLabel, version, ok, tt.version, tt.ok)
+		}
+	}
+}
+
+func TestVersionLabel(t *testing.T) {
+	tests := []struct {
+		version int
+		want    string
+	}{
+		{0, "signer"},
+		{1, "signer-v1"},
+		{7, "signer-v7"},
+	}
+	for _, tt := range tests {
+		got := VersionLabel("signer", tt.version)
+		if got != tt.want {
+			t.Errorf("VersionLabel(%d) = %q, want %q", tt.version, got, tt.want)
+		}
+		if version, ok := parseVersion("signer", got); !ok || version != tt.version {
+			t.Errorf("parseVersion(VersionLabel(%d)) = %d, %v", tt.version, version, ok)
+		}
+	}
+}
+
+func TestBaseLabel(t *testing.T) {
+	tests := []struct {
+		label string
+		want  string
+	}{
+		{"signer_priv", "signer"},
+		{"signer_pub", "signer"},
+		{"signer-v2_priv", "signer-v2"},
+		{"signer", "signer"},
+		{"signer_priv_pub", "signer_priv"},
+	}
+	for _, tt := range tests {
+		if got := BaseLabel(tt.label); got != tt.want {
+			t.Errorf("BaseLabel(%q) = %q, want %q", tt.label, got, tt.want)
+		}
+	}
+}
@@ -2,61 +2,424 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"sign-pkcs11/admin"
+	"sign-pkcs11/apierror"
+	"sign-pkcs11/auth"
 	"sign-pkcs11/create"
 	"sign-pkcs11/signature"
+	"sign-pkcs11/backup"
 	"sign-pkcs11/blockchain"
+	"sign-pkcs11/hsm"
+	"sign-pkcs11/keys"
+	"sign-pkcs11/pki"
 	"net/http"
+	"strings"
+	"time"
 	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ocsp"
 )
 
 
 type KeyRSARequest struct {
-	SlotID   int   `json:"SlotId"`
-	UserPin  string `json:"UserPin" binding:"required"`
+	SlotID   *int  `json:"SlotId"`
+	hsm.TokenRef
+	UserPin  string `json:"UserPin"`
 	KeySize  int    `json:"KeySize" binding:"required"`
 	KeyLabel string `json:"KeyLabel" binding:"required"`
+	KeyID    string `json:"KeyId"`
+	Profile  string `json:"Profile"`
 }
 
-type RSATextSign struct	{
-	SlotID   int   `json:"SlotId"`
-	UserPin  string `json:"UserPin" binding:"required"`
+type KeyECRequest struct {
+	SlotID   *int   `json:"SlotId"`
+	hsm.TokenRef
+	UserPin  string `json:"UserPin"`
+	Curve    string `json:"Curve" binding:"required"`
+	KeyLabel string `json:"KeyLabel" binding:"required"`
+	KeyID    string `json:"KeyId"`
+	Profile  string `json:"Profile"`
+}
+
+type KeyEd25519Request struct {
+	SlotID   *int   `json:"SlotId"`
+	hsm.TokenRef
+	UserPin  string `json:"UserPin"`
+	KeyLabel string `json:"KeyLabel" binding:"required"`
+	KeyID    string `json:"KeyId"`
+	Profile  string `json:"Profile"`
+}
+
+type KeyImportRequest struct {
+	SlotID   *int   `json:"SlotId"`
+	hsm.TokenRef
+	UserPin  string `json:"UserPin"`
+	Format   string `json:"Format" binding:"required"`
+	Data     string `json:"Data" binding:"required"`
+	Password string `json:"Password"`
 	KeyLabel string `json:"KeyLabel" binding:"required"`
+	KeyID    string `json:"KeyId"`
+	Profile  string `json:"Profile"`
+}
+
+type RSATextSign struct	{
+	SlotID   *int  `json:"SlotId"`
+	hsm.TokenRef
+	UserPin  string `json:"UserPin"`
+	KeyLabel string `json:"KeyLabel"`
+	KeyID    string `json:"KeyId"`
 	Signauture string `json:"Signauture" binding:"required"`
 }
 
 type RSATextVerifty struct	{
-	SlotID   int   `json:"SlotId"`
-	UserPin  string `json:"UserPin" binding:"required"`
-	KeyLabel string `json:"KeyLabel" binding:"required"`
+	SlotID   *int  `json:"SlotId"`
+	hsm.TokenRef
+	UserPin  string `json:"UserPin"`
+	KeyLabel string `json:"KeyLabel"`
+	KeyID    string `json:"KeyId"`
 	Signauture string `json:"Signauture" binding:"required"`
 	SignautureHex string `json:"SignautureHex" binding:"required"`
 
 }
 
+type KeyListQuery struct {
+	SlotID      *int   `form:"SlotId"`
+	hsm.TokenRef
+	Class       string `form:"Class"`
+	LabelPrefix string `form:"LabelPrefix"`
+}
+
+type KeyDeleteQuery struct {
+	SlotID   *int   `form:"SlotId"`
+	hsm.TokenRef
+	KeyLabel string `form:"KeyLabel"`
+	KeyID    string `form:"KeyId"`
+	DryRun   bool   `form:"DryRun"`
+	Force    bool   `form:"Force"`
+}
+
+type KeyExportQuery struct {
+	SlotID   *int   `form:"SlotId"`
+	hsm.TokenRef
+	KeyLabel string `form:"KeyLabel"`
+	KeyID    string `form:"KeyId"`
+	Format   string `form:"Format"`
+}
+
+type KeyRotateRequest struct {
+	SlotID   *int   `json:"SlotId"`
+	hsm.TokenRef
+	KeyLabel string `json:"KeyLabel" binding:"required"`
+	Profile  string `json:"Profile"`
+	UserPin  string `json:"UserPin"`
+}
+
+type CSRRequest struct {
+	SlotID   *int        `json:"SlotId"`
+	hsm.TokenRef
+	KeyLabel string      `json:"KeyLabel" binding:"required"`
+	Subject  pki.Subject `json:"Subject"`
+	pki.SubjectAltNames
+}
+
+type SelfSignedRequest struct {
+	SlotID   *int        `json:"SlotId"`
+	hsm.TokenRef
+	KeyLabel string      `json:"KeyLabel" binding:"required"`
+	Subject  pki.Subject `json:"Subject"`
+	pki.SubjectAltNames
+	pki.CertificateOptions
+}
+
+type IssueRequest struct {
+	SlotID    *int   `json:"SlotId"`
+	hsm.TokenRef
+	CALabel   string `json:"CALabel" binding:"required"`
+	CSR       string `json:"CSR" binding:"required"`
+	CertLabel string `json:"CertLabel"`
+	pki.CertificateOptions
+}
+
+type CertificateQuery struct {
+	SlotID *int   `form:"SlotId"`
+	hsm.TokenRef
+	Label  string `form:"Label"`
+	Serial string `form:"Serial"`
+	Format string `form:"Format"`
+}
+
+type RevokeRequest struct {
+	SlotID  *int   `json:"SlotId"`
+	hsm.TokenRef
+	CALabel string `json:"CALabel" binding:"required"`
+	Serial  string `json:"Serial" binding:"required"`
+	Reason  string `json:"Reason"`
+}
+
+type CRLQuery struct {
+	SlotID     *int   `form:"SlotId"`
+	hsm.TokenRef
+	CALabel    string `form:"CALabel" binding:"required"`
+	NextUpdate string `form:"NextUpdate"`
+	Format     string `form:"Format"`
+}
+
+type BackupRequest struct {
+	SlotID        *int     `json:"SlotId"`
+	hsm.TokenRef
+	UserPin       string   `json:"UserPin"`
+	WrapKeyLabel  string   `json:"WrapKeyLabel" binding:"required"`
+	CreateWrapKey bool     `json:"CreateWrapKey"`
+	KeyLabels     []string `json:"KeyLabels" binding:"required"`
+}
+
+type RestoreRequest struct {
+	SlotID       *int           `json:"SlotId"`
+	hsm.TokenRef
+	UserPin      string         `json:"UserPin"`
+	WrapKeyLabel string         `json:"WrapKeyLabel"`
+	Bundle       *backup.Bundle `json:"Bundle" binding:"required"`
+}
+
+type SlotQuery struct {
+	TokenPresent bool `form:"TokenPresent"`
+	hsm.TokenRef
+}
+
+type RandomQuery struct {
+	SlotID   *int   `form:"SlotId"`
+	hsm.TokenRef
+	Length   int    `form:"Length"`
+	Encoding string `form:"Encoding"`
+	UserPin  string `form:"UserPin"`
+}
+
+type LoginRequest struct {
+	SlotID  *int   `json:"SlotId"`
+	hsm.TokenRef
+	UserPin string `json:"UserPin" binding:"required"`
+}
+
+type SetPINRequest struct {
+	SlotID *int   `json:"SlotId"`
+	hsm.TokenRef
+	OldPin string `json:"OldPin" binding:"required"`
+	NewPin string `json:"NewPin" binding:"required"`
+}
+
+type InitPINRequest struct {
+	SlotID *int   `json:"SlotId"`
+	hsm.TokenRef
+	SoPin  string `json:"SoPin"`
+	NewPin string `json:"NewPin" binding:"required"`
+}
+
+type InitTokenRequest struct {
+	SlotID        *int   `json:"SlotId"`
+	hsm.TokenRef
+	SoPin         string `json:"SoPin"`
+	Label         string `json:"Label" binding:"required"`
+	ConfirmSerial string `json:"ConfirmSerial"`
+}
+
 type BlockChainObje struct	{
 	Data      string `json:"Data" binding:"required"`
 	Signature string `json:"Signature" binding:"required"`
+	KeyLabel  string `json:"KeyLabel"`
+}
+
+// resolveSlot isteğin kullanacağı slotu bulur: TokenLabel/TokenSerial
+// verilmişse token'ın bulunduğu slot, SlotId verilmemişse sağlayıcının
+// varsayılan slotu. Hata durumunda yanıtı yazar ve false döner.
+func resolveSlot(c *gin.Context, slotID *int, ref hsm.TokenRef) (int, bool) {
+	id, err := ref.Resolve(slotID)
+	if err != nil {
+		serverError(c, err)
+		return 0, false
+	}
+	return id, true
+}
+
+// bearerToken "Authorization: Bearer <token>" header'ındaki oturum token'ını döndürür
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// authorize isteğin sağlayıcısını, slotunu ve PIN'ini belirler. Oturum token'ı
+// gönderilmişse bunlar token'dan alınır; istek başka bir sağlayıcı veya slot
+// belirtirse 403 döner. Token yoksa slot resolveSlot ile bulunur, PIN
+// gövdedeki UserPin ya da "X-User-Pin" header'ıdır. Hata durumunda yanıtı
+// yazar ve false döner.
+func authorize(c *gin.Context, sessions *auth.Store, slotID *int, ref hsm.TokenRef, bodyPin string) (string, int, string, bool) {
+	if token := bearerToken(c); token != "" {
+		session, err := sessions.Lookup(token)
+		if err != nil {
+			writeError(c, err, nil)
+			return "", 0, "", false
+		}
+		if ref.Provider != "" && ref.Provider != session.Provider {
+			writeError(c, apierror.New(http.StatusForbidden, apierror.CodeForbidden, fmt.Sprintf("session token is bound to provider %q", session.Provider)), nil)
+			return "", 0, "", false
+		}
+		if slotID != nil || ref.TokenLabel != "" || ref.TokenSerial != "" {
+			ref.Provider = session.Provider
+			id, ok := resolveSlot(c, slotID, ref)
+			if !ok {
+				return "", 0, "", false
+			}
+			if id != session.SlotID {
+				writeError(c, apierror.New(http.StatusForbidden, apierror.CodeForbidden, fmt.Sprintf("session token is bound to slot %d", session.SlotID)), nil)
+				return "", 0, "", false
+			}
+		}
+		return session.Provider, session.SlotID, session.PIN(), true
+	}
+
+	id, ok := resolveSlot(c, slotID, ref)
+	if !ok {
+		return "", 0, "", false
+	}
+	pin := bodyPin
+	if pin == "" {
+		pin = c.GetHeader("X-User-Pin")
+	}
+	if pin == "" {
+		writeError(c, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthenticated, "UserPin, X-User-Pin header or session token is required"), nil)
+		return "", 0, "", false
+	}
+	if !pinAllowed(c) {
+		return "", 0, "", false
+	}
+	return ref.Provider, id, pin, true
+}
+
+// pinFailures istemci adresi başına yanlış PIN'leri sayar. Havuz yanlış
+// PIN'leri token'a iletmeden reddettiği için token'ın deneme sayacı yerine
+// bu sınır uygulanır; slotun diğer istemcileri etkilenmez.
+var pinFailures = auth.NewLimiter(auth.DefaultPINFailures, auth.DefaultPINWindow)
+
+// pinAllowed istemci çok fazla yanlış PIN göndermişse 429 yazar ve false döner
+func pinAllowed(c *gin.Context) bool {
+	if err := pinFailures.Allow(c.ClientIP()); err != nil {
+		writeError(c, err, nil)
+		return false
+	}
+	return true
+}
+
+// soPin gövdedeki SoPin'i, yoksa "X-SO-Pin" header'ını döndürür
+func soPin(c *gin.Context, bodyPin string) string {
+	if bodyPin != "" {
+		return bodyPin
+	}
+	return c.GetHeader("X-SO-Pin")
+}
+
+// adminError PIN ve token yönetimi hatasını yazar; onay eksikse silinecek
+// token'ın bilgisi de döner
+func adminError(c *gin.Context, result *admin.Result, err error) {
+	if errors.Is(err, admin.ErrConfirmationRequired) {
+		writeError(c, err, gin.H{"token": result.Token})
+		return
+	}
+	serverError(c, err)
+}
+
+// writeError hatayı {"error": {"code", "message", "ckr"}} zarfıyla yazar;
+// HTTP durumu ve kod apierror.From ile belirlenir. extra alanlar zarfın
+// yanına eklenir.
+func writeError(c *gin.Context, err error, extra gin.H) {
+	apiErr := apierror.From(err)
+	if apiErr.Code == apierror.CodePinIncorrect {
+		pinFailures.Fail(c.ClientIP())
+	}
+	body := gin.H{"error": apiErr}
+	for k, v := range extra {
+		body[k] = v
+	}
+	c.JSON(apiErr.Status, body)
+}
+
+// badRequest geçersiz istek gövdesi veya parametresi için 400 yazar
+func badRequest(c *gin.Context, err error) {
+	writeError(c, apierror.New(http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error()), nil)
+}
+
+// serverError HSM işlemi hatasını yazar. Mekanizma/anahtar boyutu
+// desteklenmiyorsa 422 ile birlikte mekanizma ayrıntıları da döner.
+func serverError(c *gin.Context, err error) {
+	var mechErr *hsm.MechanismError
+	if errors.As(err, &mechErr) {
+		writeError(c, err, gin.H{"mechanism": mechErr})
+		return
+	}
+	writeError(c, err, nil)
 }
 
 func main() {
     router := gin.Default()
 
+	// PKCS#11 sağlayıcılarını yükle; her modül ilk kullanımda bir kez
+	// başlatılır, oturumlar slot başına havuzdan alınır
+	providers, err := hsm.ProvidersFromEnv()
+	if err != nil {
+		log.Fatalf("PKCS#11 ayarları okunamadı: %v", err)
+	}
+	if err := hsm.Init(providers); err != nil {
+		log.Fatalf("PKCS#11 sağlayıcıları başlatılamadı: %v", err)
+	}
+	defer hsm.Shutdown()
+	// HA grubu üyelerinin slotlarında token bulunmalı; yanlış eşlenmiş bir
+	// üye ilk failover'da değil açılışta fark edilir
+	if err := hsm.CheckGroups(); err != nil {
+		log.Fatalf("HA grubu doğrulanamadı: %v", err)
+	}
+
 
 	// Blockchain'i başlat
 	bc := blockchain.NewBlockchain()
 	defer bc.Close()
 
+	// Oturum token'ları; süreler ortam değişkenlerinden okunur
+	sessionConfig, err := auth.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Oturum ayarları okunamadı: %v", err)
+	}
+	sessions := auth.NewStore(sessionConfig)
+	defer sessions.Close()
+
+	// OCSP responder ayarlarını ortam değişkenlerinden oku
+	ocspResponder, err := pki.NewOCSPResponder(bc)
+	if err != nil {
+		log.Fatalf("OCSP responder başlatılamadı: %v", err)
+	}
+
 	// Yeni blok ekleme endpoint'i
 	router.POST("/BlockChain/Add", func(c *gin.Context) {
 		var request BlockChainObje
 
 		if err := c.ShouldBindJSON(&request); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			badRequest(c, err)
 			return
 		}
 
-		bc.AddBlock(request.Data, request.Signature)
+		bc.AddKeyBlock(request.Data, request.Signature, request.KeyLabel)
 		c.JSON(http.StatusOK, gin.H{"message": "Yeni blok eklendi."})
 	})
 	router.GET("/BlockChain/List", func(c *gin.Context) {
@@ -67,11 +430,16 @@ func main() {
 	router.POST("/RSA/Text/Verifty", func(c *gin.Context) {
 		var req RSATextVerifty
 		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, req.UserPin)
+		if !ok {
+			return
 		}
-		result, err := signature.RSAVerftStr(req.SlotID, req.UserPin, req.KeyLabel, req.Signauture, req.SignautureHex)
+		result, err := signature.RSAVerftStr(provider, slotID, userPin, req.KeyLabel, req.KeyID, req.Signauture, req.SignautureHex)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			serverError(c, err)
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"message": result})
@@ -83,12 +451,16 @@ func main() {
 	router.POST("/RSA/Text/Signature", func(c *gin.Context) {
 		var req RSATextSign
 		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, req.UserPin)
+		if !ok {
+			return
 		}
-		fmt.Println(req.SlotID)
-		result, err := signature.RSASignStr(req.SlotID, req.UserPin, req.KeyLabel, req.Signauture)
+		result, err := signature.RSASignStr(provider, slotID, userPin, req.KeyLabel, req.KeyID, req.Signauture)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			serverError(c, err)
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"message": result})
@@ -98,23 +470,675 @@ func main() {
 		var req KeyRSARequest
 
 		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, req.UserPin)
+		if !ok {
 			return
 		}
 		// RSA anahtar oluşturma
-		fmt.Println(req.SlotID)
-		result, err := create.GenerateRSAKey(req.SlotID, req.UserPin, req.KeySize, req.KeyLabel)
+		result, err := create.GenerateRSAKey(provider, slotID, userPin, req.KeySize, req.KeyLabel, req.KeyID, req.Profile)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": result})
+	})
+
+	// POST endpoint for EC key generation
+	router.POST("/create/ecCreate", func(c *gin.Context) {
+		var req KeyECRequest
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, req.UserPin)
+		if !ok {
+			return
+		}
+		// EC anahtar oluşturma
+		result, err := create.GenerateECKey(provider, slotID, userPin, req.Curve, req.KeyLabel, req.KeyID, req.Profile)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			serverError(c, err)
 			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{"message": result})
 	})
+
+	// PKCS#8 PEM veya PKCS#12 içindeki anahtarı (ve sertifika zincirini) token'a aktarır
+	router.POST("/create/import", func(c *gin.Context) {
+		var req KeyImportRequest
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, req.UserPin)
+		if !ok {
+			return
+		}
+		result, err := create.ImportKey(provider, slotID, userPin, req.Format, req.Data, req.Password, req.KeyLabel, req.KeyID, req.Profile)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": result})
+	})
+
+	router.POST("/Ed25519/Create", func(c *gin.Context) {
+		var req KeyEd25519Request
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, req.UserPin)
+		if !ok {
+			return
+		}
+		result, err := create.GenerateEd25519Key(provider, slotID, userPin, req.KeyLabel, req.KeyID, req.Profile)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": result})
+	})
+
+	router.POST("/Ed25519/Text/Signature", func(c *gin.Context) {
+		var req RSATextSign
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, req.UserPin)
+		if !ok {
+			return
+		}
+		result, err := signature.Ed25519SignStr(provider, slotID, userPin, req.KeyLabel, req.KeyID, req.Signauture)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": result})
+	})
+
+	router.POST("/Ed25519/Text/Verifty", func(c *gin.Context) {
+		var req RSATextVerifty
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, req.UserPin)
+		if !ok {
+			return
+		}
+		result, err := signature.Ed25519VerifyStr(provider, slotID, userPin, req.KeyLabel, req.KeyID, req.Signauture, req.SignautureHex)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": result})
+	})
+
+	// Token üzerindeki anahtarları listeler; PIN "X-User-Pin" header'ı ya da oturum token'ı ile gönderilir
+	router.GET("/keys", func(c *gin.Context) {
+		var req KeyListQuery
+		if err := c.ShouldBindQuery(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, "")
+		if !ok {
+			return
+		}
+		result, err := keys.ListKeys(provider, slotID, userPin, keys.ListFilter{Class: req.Class, LabelPrefix: req.LabelPrefix})
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	// Anahtar çiftini siler; DryRun ile sadece silinecek objeleri raporlar
+	router.DELETE("/keys", func(c *gin.Context) {
+		var req KeyDeleteQuery
+		if err := c.ShouldBindQuery(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, "")
+		if !ok {
+			return
+		}
+		result, err := keys.DeleteKeyPair(provider, slotID, userPin, req.KeyLabel, req.KeyID, req.DryRun, req.Force, bc)
+		switch {
+		case err != nil && result != nil:
+			writeError(c, err, gin.H{"result": result})
+			return
+		case err != nil:
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	// Public key'i PEM, DER (base64) veya JWK olarak dışa aktarır
+	router.GET("/keys/export", func(c *gin.Context) {
+		var req KeyExportQuery
+		if err := c.ShouldBindQuery(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, "")
+		if !ok {
+			return
+		}
+		result, err := keys.ExportPublicKey(provider, slotID, userPin, req.KeyLabel, req.KeyID, req.Format)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	// Anahtarın yeni sürümünü (<base>-v<N>) üretir, eski sürümleri yalnızca
+	// doğrulama yapabilir hale getirir ve rotasyonu defter'e yazar
+	router.POST("/keys/rotate", func(c *gin.Context) {
+		var req KeyRotateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, req.UserPin)
+		if !ok {
+			return
+		}
+		result, err := keys.RotateKey(provider, slotID, userPin, req.KeyLabel, req.Profile, bc)
+		switch {
+		case err != nil && result == nil:
+			serverError(c, err)
+			return
+		case err != nil:
+			writeError(c, err, gin.H{"result": result})
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	router.POST("/pki/csr", func(c *gin.Context) {
+		var req CSRRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, "")
+		if !ok {
+			return
+		}
+		result, err := pki.CreateCSR(provider, slotID, userPin, req.KeyLabel, req.Subject, req.SubjectAltNames)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	router.POST("/pki/certificates/self-signed", func(c *gin.Context) {
+		var req SelfSignedRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, "")
+		if !ok {
+			return
+		}
+		result, err := pki.SelfSign(provider, slotID, userPin, req.KeyLabel, req.Subject, req.SubjectAltNames, req.CertificateOptions)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	router.POST("/pki/certificates", func(c *gin.Context) {
+		var req IssueRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, "")
+		if !ok {
+			return
+		}
+		result, err := pki.IssueCertificate(provider, slotID, userPin, req.CALabel, req.CSR, req.CertLabel, req.CertificateOptions)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	router.GET("/pki/certificates", func(c *gin.Context) {
+		var req CertificateQuery
+		if err := c.ShouldBindQuery(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, "")
+		if !ok {
+			return
+		}
+		result, err := pki.ListCertificates(provider, slotID, userPin)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	router.GET("/pki/certificates/download", func(c *gin.Context) {
+		var req CertificateQuery
+		if err := c.ShouldBindQuery(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, "")
+		if !ok {
+			return
+		}
+		cert, err := pki.GetCertificate(provider, slotID, userPin, req.Label, req.Serial)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		name := fmt.Sprintf("%x", cert.SerialNumber)
+		switch req.Format {
+		case "", "pem":
+			c.Header("Content-Disposition", "attachment; filename="+name+".pem")
+			c.Data(http.StatusOK, "application/x-pem-file", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+		case "der":
+			c.Header("Content-Disposition", "attachment; filename="+name+".cer")
+			c.Data(http.StatusOK, "application/pkix-cert", cert.Raw)
+		default:
+			badRequest(c, fmt.Errorf("unsupported format: %s (supported: pem, der)", req.Format))
+		}
+	})
+
+	router.POST("/pki/revoke", func(c *gin.Context) {
+		var req RevokeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, "")
+		if !ok {
+			return
+		}
+		result, err := pki.Revoke(provider, slotID, userPin, req.CALabel, req.Serial, req.Reason, bc)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	router.GET("/pki/crl", func(c *gin.Context) {
+		var req CRLQuery
+		if err := c.ShouldBindQuery(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, "")
+		if !ok {
+			return
+		}
+		var nextUpdate time.Duration
+		if req.NextUpdate != "" {
+			var err error
+			if nextUpdate, err = time.ParseDuration(req.NextUpdate); err != nil {
+				badRequest(c, fmt.Errorf("invalid NextUpdate: %w", err))
+				return
+			}
+		}
+		if req.Format != "" && req.Format != "pem" && req.Format != "der" {
+			badRequest(c, fmt.Errorf("unsupported format: %s (supported: pem, der)", req.Format))
+			return
+		}
+		crl, err := pki.CreateCRL(provider, slotID, userPin, req.CALabel, nextUpdate, bc)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		c.Header("X-CRL-Number", crl.Number.String())
+		c.Header("X-CRL-Next-Update", crl.NextUpdate.Format(time.RFC3339))
+		if req.Format == "der" {
+			c.Header("Content-Disposition", "attachment; filename=crl.crl")
+			c.Data(http.StatusOK, "application/pkix-crl", crl.DER)
+			return
+		}
+		c.Header("Content-Disposition", "attachment; filename=crl.pem")
+		c.Data(http.StatusOK, "application/x-pem-file", pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl.DER}))
+	})
+
+	router.GET("/ocsp/*request", func(c *gin.Context) {
+		encoded := strings.TrimPrefix(c.Param("request"), "/")
+		request, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			request, err = base64.RawStdEncoding.DecodeString(encoded)
+		}
+		if err != nil {
+			c.Data(http.StatusOK, "application/ocsp-response", ocsp.MalformedRequestErrorResponse)
+			return
+		}
+		c.Data(http.StatusOK, "application/ocsp-response", ocspResponder.Respond(request))
+	})
+
+	router.POST("/ocsp", func(c *gin.Context) {
+		request, err := io.ReadAll(io.LimitReader(c.Request.Body, 64*1024))
+		if err != nil {
+			c.Data(http.StatusOK, "application/ocsp-response", ocsp.MalformedRequestErrorResponse)
+			return
+		}
+		c.Data(http.StatusOK, "application/ocsp-response", ocspResponder.Respond(request))
+	})
+
+	// Slota giriş yapar ve kısa ömürlü bir oturum token'ı döndürür
+	router.POST("/auth/login", func(c *gin.Context) {
+		var req LoginRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		slotID, ok := resolveSlot(c, req.SlotID, req.TokenRef)
+		if !ok || !pinAllowed(c) {
+			return
+		}
+		result, err := sessions.Login(req.Provider, slotID, req.UserPin)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	// Oturum token'ını iptal eder
+	router.POST("/auth/logout", func(c *gin.Context) {
+		if err := sessions.Logout(bearerToken(c)); err != nil {
+			writeError(c, err, nil)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// Oturum token'ının bilgileri; boşta kalma süresini yeniler
+	router.GET("/auth/session", func(c *gin.Context) {
+		session, err := sessions.Lookup(bearerToken(c))
+		if err != nil {
+			writeError(c, err, nil)
+			return
+		}
+		c.JSON(http.StatusOK, session)
+	})
+
+	// Kullanıcı PIN'ini değiştirir (C_SetPIN); slotun oturum token'ları iptal edilir
+	router.POST("/admin/pin", func(c *gin.Context) {
+		var req SetPINRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		slotID, ok := resolveSlot(c, req.SlotID, req.TokenRef)
+		if !ok || !pinAllowed(c) {
+			return
+		}
+		result, err := admin.SetPIN(req.Provider, slotID, req.OldPin, req.NewPin, bc)
+		if err != nil {
+			adminError(c, result, err)
+			return
+		}
+		sessions.RevokeSlot(req.Provider, slotID)
+		c.JSON(http.StatusOK, result)
+	})
+
+	// Kullanıcı PIN'ini SO olarak yeniden belirler (C_InitPIN)
+	router.POST("/admin/pin/init", func(c *gin.Context) {
+		var req InitPINRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		slotID, ok := resolveSlot(c, req.SlotID, req.TokenRef)
+		if !ok {
+			return
+		}
+		result, err := admin.InitPIN(req.Provider, slotID, soPin(c, req.SoPin), req.NewPin, bc)
+		if err != nil {
+			adminError(c, result, err)
+			return
+		}
+		sessions.RevokeSlot(req.Provider, slotID)
+		c.JSON(http.StatusOK, result)
+	})
+
+	// Token'ı siler ve yeniden başlatır (C_InitToken); ConfirmSerial token'ın
+	// seri numarasıyla aynı olmalıdır, değilse 428 ile token bilgisi döner
+	router.POST("/admin/token/init", func(c *gin.Context) {
+		var req InitTokenRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		slotID, ok := resolveSlot(c, req.SlotID, req.TokenRef)
+		if !ok {
+			return
+		}
+		result, err := admin.InitToken(req.Provider, slotID, soPin(c, req.SoPin), req.Label, req.ConfirmSerial, bc)
+		if err != nil {
+			adminError(c, result, err)
+			return
+		}
+		sessions.RevokeSlot(req.Provider, slotID)
+		c.JSON(http.StatusOK, result)
+	})
+
+	// HSM RNG'sinden (C_GenerateRandom) rastgele bayt üretir; oturum token'ı
+	// veya kullanıcı PIN'i gerekir ve her çağrı defter'e yazılır
+	router.GET("/random", func(c *gin.Context) {
+		var req RandomQuery
+		if err := c.ShouldBindQuery(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		if req.Length == 0 {
+			req.Length = 32
+		}
+		if req.Length < 0 || req.Length > hsm.MaxRandomLength {
+			badRequest(c, fmt.Errorf("Length must be between 1 and %d", hsm.MaxRandomLength))
+			return
+		}
+		if req.Encoding == "" {
+			req.Encoding = "hex"
+		}
+		if req.Encoding != "hex" && req.Encoding != "base64" {
+			badRequest(c, fmt.Errorf("unsupported encoding: %s (supported: hex, base64)", req.Encoding))
+			return
+		}
+		provider, slotID, pin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, req.UserPin)
+		if !ok {
+			return
+		}
+		random, err := hsm.Random(provider, slotID, pin, req.Length)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+
+		// Çağıran: oturum token'ı varsa oturum kimliği, yoksa istemci IP'si
+		caller := "pin:" + c.ClientIP()
+		if token := bearerToken(c); token != "" {
+			if session, err := sessions.Lookup(token); err == nil {
+				caller = "session:" + session.ID
+			}
+		}
+		entry, _ := json.Marshal(map[string]interface{}{
+			"event":    "random",
+			"provider": provider,
+			"slot_id":  slotID,
+			"length":   req.Length,
+			"caller":   caller,
+			"time":     time.Now().UTC().Format(time.RFC3339),
+		})
+		bc.AddBlock(string(entry), "")
+		encoded := hex.EncodeToString(random)
+		if req.Encoding == "base64" {
+			encoded = base64.StdEncoding.EncodeToString(random)
+		}
+		c.JSON(http.StatusOK, gin.H{"random": encoded, "encoding": req.Encoding, "length": req.Length})
+	})
+
+	// Yapılandırılmış PKCS#11 sağlayıcıları
+	router.GET("/providers", func(c *gin.Context) {
+		providers, err := hsm.ListProviders()
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, providers)
+	})
+
+	// HA grupları ve üyelerinin sağlık durumu
+	router.GET("/providers/groups", func(c *gin.Context) {
+		groups, err := hsm.ListGroups()
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, groups)
+	})
+
+	// Slot, token ve mekanizma bilgileri; PIN gerektirmez
+	router.GET("/slots", func(c *gin.Context) {
+		var req SlotQuery
+		if err := c.ShouldBindQuery(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		if req.TokenLabel != "" || req.TokenSerial != "" {
+			slotID, err := hsm.FindSlot(req.Provider, req.TokenLabel, req.TokenSerial)
+			if err != nil {
+				serverError(c, err)
+				return
+			}
+			slot, err := hsm.GetSlot(req.Provider, slotID)
+			if err != nil {
+				serverError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, []*hsm.SlotInfo{slot})
+			return
+		}
+		slots, err := hsm.ListSlots(req.Provider, req.TokenPresent)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, slots)
+	})
+
+	router.GET("/slots/:slotId", func(c *gin.Context) {
+		slotID, err := strconv.Atoi(c.Param("slotId"))
+		if err != nil {
+			badRequest(c, fmt.Errorf("invalid slot ID: %s", c.Param("slotId")))
+			return
+		}
+		slot, err := hsm.GetSlot(c.Query("Provider"), slotID)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, slot)
+	})
+
+	router.GET("/slots/:slotId/mechanisms", func(c *gin.Context) {
+		slotID, err := strconv.Atoi(c.Param("slotId"))
+		if err != nil {
+			badRequest(c, fmt.Errorf("invalid slot ID: %s", c.Param("slotId")))
+			return
+		}
+		mechanisms, err := hsm.Mechanisms(c.Query("Provider"), slotID)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, mechanisms)
+	})
+
+	// Seçilen özel anahtarları AES wrap key ile sarmalayıp yedek paketi döndürür
+	router.POST("/backup", func(c *gin.Context) {
+		var req BackupRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, req.UserPin)
+		if !ok {
+			return
+		}
+		wrapKey := backup.WrapKeyOptions{Label: req.WrapKeyLabel, Create: req.CreateWrapKey}
+		bundle, err := backup.Backup(provider, slotID, userPin, wrapKey, req.KeyLabels)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, bundle)
+	})
+
+	// Yedek paketindeki anahtarları UnwrapKey ile aynı veya farklı slota geri yükler
+	router.POST("/backup/restore", func(c *gin.Context) {
+		var req RestoreRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, err)
+			return
+		}
+		provider, slotID, userPin, ok := authorize(c, sessions, req.SlotID, req.TokenRef, req.UserPin)
+		if !ok {
+			return
+		}
+		restored, err := backup.Restore(provider, slotID, userPin, req.WrapKeyLabel, req.Bundle)
+		if err != nil {
+			writeError(c, err, gin.H{"restored": restored})
+			return
+		}
+		c.JSON(http.StatusOK, restored)
+	})
 	
 
 
 
-    router.Run(":8080")
+	srv := &http.Server{Addr: ":8080", Handler: router}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Sunucu başlatılamadı: %v", err)
+		}
+	}()
+
+	// SIGINT/SIGTERM gelince açık istekleri bitir; defer'lar oturumları ve
+	// veritabanını kapatır
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Sunucu kapatılamadı: %v", err)
+	}
 }
 // EC import işlemi için Start
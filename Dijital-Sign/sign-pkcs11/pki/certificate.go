@@ -0,0 +1,478 @@
+// Package pki builds X.509 objects (certificate signing requests,
+// certificates, CRLs and OCSP responses) signed by keys held on the token.
+package pki
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sign-pkcs11/hsm"
+	"sign-pkcs11/signature"
+	"strings"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// DefaultValidityDays is used when a request does not set ValidityDays
+const DefaultValidityDays = 365
+
+// ErrCertificateNotFound is returned when no certificate matches a lookup
+var ErrCertificateNotFound = errors.New("certificate not found")
+
+// extKeyUsages maps the names accepted in requests to x509 extended key usages
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"serverAuth":      x509.ExtKeyUsageServerAuth,
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"timeStamping":    x509.ExtKeyUsageTimeStamping,
+	"ocspSigning":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// CertificateOptions are the issuance settings shared by self-signed and
+// CA-issued certificates
+type CertificateOptions struct {
+	ValidityDays int      `json:"ValidityDays"`
+	IsCA         bool     `json:"IsCA"`
+	MaxPathLen   int      `json:"MaxPathLen"` // only for CA certificates; 0 means no limit
+	ExtKeyUsage  []string `json:"ExtKeyUsage"`
+}
+
+// CertificateInfo describes a certificate object stored on the token
+type CertificateInfo struct {
+	Handle    pkcs11.ObjectHandle `json:"handle"`
+	Label     string              `json:"label"`
+	KeyID     string              `json:"key_id"`
+	Serial    string              `json:"serial"`
+	Subject   string              `json:"subject"`
+	Issuer    string              `json:"issuer"`
+	NotBefore time.Time           `json:"not_before"`
+	NotAfter  time.Time           `json:"not_after"`
+	IsCA      bool                `json:"is_ca"`
+	PEM       string              `json:"pem,omitempty"`
+}
+
+// storedCertificate is a parsed certificate object
+type storedCertificate struct {
+	handle pkcs11.ObjectHandle
+	label  string
+	keyID  []byte
+	cert   *x509.Certificate
+}
+
+// info converts a stored certificate for responses
+func (sc storedCertificate) info(withPEM bool) CertificateInfo {
+	info := CertificateInfo{
+		Handle:    sc.handle,
+		Label:     sc.label,
+		KeyID:     hex.EncodeToString(sc.keyID),
+		Serial:    serialHex(sc.cert.SerialNumber),
+		Subject:   sc.cert.Subject.String(),
+		Issuer:    sc.cert.Issuer.String(),
+		NotBefore: sc.cert.NotBefore,
+		NotAfter:  sc.cert.NotAfter,
+		IsCA:      sc.cert.IsCA,
+	}
+	if withPEM {
+		info.PEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: sc.cert.Raw}))
+	}
+	return info
+}
+
+// SelfSign creates a self-signed certificate for a key pair on the token and
+// stores it as <base>_cert under the key's CKA_ID. With IsCA set the
+// certificate can act as the root for IssueCertificate.
+func SelfSign(provider string, slotID int, userPin string, keyLabel string, subject Subject, san SubjectAltNames, opts CertificateOptions) (*CertificateInfo, error) {
+	ips, uris, err := san.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := hsm.Open(provider, slotID, userPin)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	signer, err := signature.NewSessionSigner(s, keyLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := newTemplate(opts, signer.Public(), time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	template.Subject = subject.Name()
+	template.DNSNames = san.DNSNames
+	template.EmailAddresses = san.EmailAddresses
+	template.IPAddresses = ips
+	template.URIs = uris
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	label := strings.TrimSuffix(signer.Label(), "_priv") + "_cert"
+	return storeIssued(s, der, label, signer.KeyID())
+}
+
+// IssueCertificate signs a PEM encoded PKCS#10 request with a CA key on the
+// token. The CA key's certificate must be stored on the token with the same
+// CKA_ID. The issued certificate is stored under certLabel, linked to the
+// CKA_ID of the matching key pair when the requested key lives on this token.
+func IssueCertificate(provider string, slotID int, userPin string, caLabel string, csrPEM string, certLabel string, opts CertificateOptions) (*CertificateInfo, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("CSR must be a PEM encoded CERTIFICATE REQUEST")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSR: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("CSR signature is invalid: %w", err)
+	}
+
+	s, err := hsm.Open(provider, slotID, userPin)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	signer, err := signature.NewSessionSigner(s, caLabel)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := caCertificate(s, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := newTemplate(opts, csr.PublicKey, ca.cert.NotAfter)
+	if err != nil {
+		return nil, err
+	}
+	template.Subject = csr.Subject
+	template.DNSNames = csr.DNSNames
+	template.EmailAddresses = csr.EmailAddresses
+	template.IPAddresses = csr.IPAddresses
+	template.URIs = csr.URIs
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	keyID := template.SubjectKeyId
+	if id, ok := tokenKeyID(s, csr.PublicKey); ok {
+		keyID = id
+	}
+	if certLabel == "" {
+		certLabel = "cert-" + serialHex(template.SerialNumber)
+	}
+	return storeIssued(s, der, certLabel, keyID)
+}
+
+// ListCertificates returns every X.509 certificate object on the token. The
+// read is repeated after a reconnect, or on another member of an HA group,
+// when the session or device is lost.
+func ListCertificates(provider string, slotID int, userPin string) ([]CertificateInfo, error) {
+	var result []CertificateInfo
+	err := hsm.Failover(provider, slotID, func(provider string, slotID int) (err error) {
+		result, err = listCertificates(provider, slotID, userPin)
+		return err
+	})
+	return result, err
+}
+
+// listCertificates is ListCertificates on a single slot
+func listCertificates(provider string, slotID int, userPin string) ([]CertificateInfo, error) {
+	s, err := hsm.Open(provider, slotID, userPin)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	stored, err := findCertificates(s, nil)
+	if err != nil {
+		return nil, err
+	}
+	result := []CertificateInfo{}
+	for _, sc := range stored {
+		result = append(result, sc.info(false))
+	}
+	return result, nil
+}
+
+// GetCertificate returns the certificate with the label and/or hex serial.
+// The read is repeated after a reconnect, or on another member of an HA
+// group, when the session or device is lost.
+func GetCertificate(provider string, slotID int, userPin string, label string, serial string) (*x509.Certificate, error) {
+	var result *x509.Certificate
+	err := hsm.Failover(provider, slotID, func(provider string, slotID int) (err error) {
+		result, err = getCertificate(provider, slotID, userPin, label, serial)
+		return err
+	})
+	return result, err
+}
+
+// getCertificate is GetCertificate on a single slot
+func getCertificate(provider string, slotID int, userPin string, label string, serial string) (*x509.Certificate, error) {
+	if label == "" && serial == "" {
+		return nil, fmt.Errorf("Label or Serial is required")
+	}
+	if serial != "" {
+		var err error
+		if serial, err = normalizeSerial(serial); err != nil {
+			return nil, err
+		}
+	}
+
+	s, err := hsm.Open(provider, slotID, userPin)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	var template []*pkcs11.Attribute
+	if label != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, label))
+	}
+	stored, err := findCertificates(s, template)
+	if err != nil {
+		return nil, err
+	}
+	for _, sc := range stored {
+		if serial == "" || serialHex(sc.cert.SerialNumber) == serial {
+			return sc.cert, nil
+		}
+	}
+	return nil, ErrCertificateNotFound
+}
+
+// newTemplate fills in the serial number, validity, key usage and basic
+// constraints of a new certificate. notAfterLimit, when set, caps the
+// validity at the issuing CA's expiry.
+func newTemplate(opts CertificateOptions, pub crypto.PublicKey, notAfterLimit time.Time) (*x509.Certificate, error) {
+	if opts.ValidityDays < 0 {
+		return nil, fmt.Errorf("ValidityDays must not be negative")
+	}
+	if opts.ValidityDays == 0 {
+		opts.ValidityDays = DefaultValidityDays
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	ski, err := subjectKeyID(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Backdate slightly to tolerate clock skew on relying parties
+	notBefore := time.Now().Add(-5 * time.Minute).UTC()
+	notAfter := notBefore.AddDate(0, 0, opts.ValidityDays)
+	if !notAfterLimit.IsZero() {
+		if !notAfterLimit.After(time.Now()) {
+			return nil, fmt.Errorf("CA certificate expired at %s", notAfterLimit)
+		}
+		if notAfter.After(notAfterLimit) {
+			notAfter = notAfterLimit
+		}
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		SubjectKeyId:          ski,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+	}
+	if opts.IsCA {
+		template.IsCA = true
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		template.MaxPathLen = opts.MaxPathLen
+	} else if _, ok := pub.(*rsa.PublicKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	for _, name := range opts.ExtKeyUsage {
+		usage, ok := extKeyUsages[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported extended key usage: %s", name)
+		}
+		template.ExtKeyUsage = append(template.ExtKeyUsage, usage)
+	}
+	return template, nil
+}
+
+// storeIssued parses a freshly signed certificate and stores it on the token
+func storeIssued(s *hsm.Session, der []byte, label string, keyID []byte) (*CertificateInfo, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse issued certificate: %w", err)
+	}
+	existing, err := findCertificates(s, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, label)})
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return nil, fmt.Errorf("a certificate labelled %s already exists on the slot", label)
+	}
+
+	handle, err := s.StoreCertificate(cert, label, keyID)
+	if err != nil {
+		return nil, err
+	}
+	info := storedCertificate{handle: handle, label: label, keyID: keyID, cert: cert}.info(true)
+	return &info, nil
+}
+
+// findCertificates returns the X.509 certificate objects matching the extra
+// template attributes
+func findCertificates(s *hsm.Session, extra []*pkcs11.Attribute) ([]storedCertificate, error) {
+	template := append([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+		pkcs11.NewAttribute(pkcs11.CKA_CERTIFICATE_TYPE, pkcs11.CKC_X_509),
+	}, extra...)
+	handles, err := s.FindObjects(template)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored []storedCertificate
+	for _, handle := range handles {
+		value, err := s.Attribute(handle, pkcs11.CKA_VALUE)
+		if err != nil {
+			continue
+		}
+		cert, err := x509.ParseCertificate(value)
+		if err != nil {
+			continue
+		}
+		sc := storedCertificate{handle: handle, cert: cert}
+		if v, err := s.Attribute(handle, pkcs11.CKA_LABEL); err == nil {
+			sc.label = string(v)
+		}
+		if v, err := s.Attribute(handle, pkcs11.CKA_ID); err == nil {
+			sc.keyID = v
+		}
+		stored = append(stored, sc)
+	}
+	return stored, nil
+}
+
+// caCertificate finds the CA certificate for a signing key: a stored CA
+// certificate whose public key is the signer's
+func caCertificate(s *hsm.Session, signer *signature.Signer) (*storedCertificate, error) {
+	var extra []*pkcs11.Attribute
+	if len(signer.KeyID()) > 0 {
+		extra = append(extra, pkcs11.NewAttribute(pkcs11.CKA_ID, signer.KeyID()))
+	}
+	stored, err := findCertificates(s, extra)
+	if err != nil {
+		return nil, err
+	}
+	want, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode CA public key: %w", err)
+	}
+
+	var found *storedCertificate
+	for i, sc := range stored {
+		if !sc.cert.IsCA || !bytes.Equal(sc.cert.RawSubjectPublicKeyInfo, want) {
+			continue
+		}
+		// Prefer the certificate that stays valid longest
+		if found == nil || sc.cert.NotAfter.After(found.cert.NotAfter) {
+			found = &stored[i]
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no CA certificate found for %s, create one with IsCA set first", signer.Label())
+	}
+	return found, nil
+}
+
+// tokenKeyID returns the CKA_ID of the public key object on the token that
+// holds pub
+func tokenKeyID(s *hsm.Session, pub crypto.PublicKey) ([]byte, bool) {
+	want, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, false
+	}
+	handles, err := s.FindObjects([]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY)})
+	if err != nil {
+		return nil, false
+	}
+	for _, handle := range handles {
+		candidate, err := s.PublicKey(handle)
+		if err != nil {
+			continue
+		}
+		der, err := x509.MarshalPKIXPublicKey(candidate)
+		if err != nil || !bytes.Equal(der, want) {
+			continue
+		}
+		if id, err := s.Attribute(handle, pkcs11.CKA_ID); err == nil && len(id) > 0 {
+			return id, true
+		}
+	}
+	return nil, false
+}
+
+// subjectKeyID computes the RFC 5280 method 1 key identifier: the SHA-1 of
+// the subjectPublicKey bit string
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %w", err)
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, fmt.Errorf("failed to decode public key: %w", err)
+	}
+	sum := sha1.Sum(spki.PublicKey.Bytes)
+	return sum[:], nil
+}
+
+// newSerial returns a random positive 128-bit serial number
+func newSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial.Add(serial, big.NewInt(1)), nil
+}
+
+// serialHex formats a serial number as lower case hex
+func serialHex(serial *big.Int) string {
+	return serial.Text(16)
+}
+
+// normalizeSerial parses a hex serial, optionally with a 0x prefix, colons
+// or leading zeros, into the form serialHex produces. Signs are rejected:
+// big.Int would accept them, but serial numbers are positive.
+func normalizeSerial(serial string) (string, error) {
+	value := strings.ReplaceAll(strings.TrimPrefix(strings.ToLower(serial), "0x"), ":", "")
+	n, ok := new(big.Int).SetString(value, 16)
+	if !ok || strings.ContainsAny(value, "+-") {
+		return "", fmt.Errorf("invalid serial number: %s", serial)
+	}
+	return serialHex(n), nil
+}
@@ -0,0 +1,51 @@
+package pki
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestNormalizeSerial(t *testing.T) {
+	tests := []struct {
+		serial  string
+		want    string
+		wantErr bool
+	}{
+		{"1a2b", "1a2b", false},
+		{"1A2B", "1a2b", false},
+		{"0x1a2b", "1a2b", false},
+		{"0X1A2B", "1a2b", false},
+		{"1a:2b", "1a2b", false},
+		{"00:00:1a:2b", "1a2b", false},
+		{"00", "0", false},
+		{"7f:ff:ff:ff:ff:ff:ff:ff:ff:ff:ff:ff:ff:ff:ff:ff:ff:ff:ff:ff", "7fffffffffffffffffffffffffffffffffffffff", false},
+		{"", "", true},
+		{"0x", "", true},
+		{"xyz", "", true},
+		{"1a 2b", "", true},
+		{"-1", "", true},
+		{"+1", "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeSerial(tt.serial)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("normalizeSerial(%q) error = %v, wantErr %v", tt.serial, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeSerial(%q) = %q, want %q", tt.serial, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeSerialMatchesSerialHex(t *testing.T) {
+	for _, n := range []*big.Int{big.NewInt(1), big.NewInt(0xabcdef), new(big.Int).Lsh(big.NewInt(1), 159)} {
+		got, err := normalizeSerial(serialHex(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != serialHex(n) {
+			t.Errorf("normalizeSerial(serialHex(%v)) = %s", n, got)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package pki
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/url"
+	"sign-pkcs11/hsm"
+	"sign-pkcs11/signature"
+)
+
+// Subject holds the distinguished name fields accepted in requests
+type Subject struct {
+	CommonName         string   `json:"CommonName"`
+	Organization       []string `json:"Organization"`
+	OrganizationalUnit []string `json:"OrganizationalUnit"`
+	Country            []string `json:"Country"`
+	Province           []string `json:"Province"`
+	Locality           []string `json:"Locality"`
+	SerialNumber       string   `json:"SerialNumber"`
+}
+
+// Name converts the subject into a pkix.Name
+func (s Subject) Name() pkix.Name {
+	return pkix.Name{
+		CommonName:         s.CommonName,
+		Organization:       s.Organization,
+		OrganizationalUnit: s.OrganizationalUnit,
+		Country:            s.Country,
+		Province:           s.Province,
+		Locality:           s.Locality,
+		SerialNumber:       s.SerialNumber,
+	}
+}
+
+// SubjectAltNames holds the subject alternative names accepted in requests
+type SubjectAltNames struct {
+	DNSNames       []string `json:"DNSNames"`
+	IPAddresses    []string `json:"IPAddresses"`
+	EmailAddresses []string `json:"EmailAddresses"`
+	URIs           []string `json:"URIs"`
+}
+
+// parse validates the IP addresses and URIs
+func (san SubjectAltNames) parse() ([]net.IP, []*url.URL, error) {
+	var ips []net.IP
+	for _, value := range san.IPAddresses {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("invalid IP address: %s", value)
+		}
+		ips = append(ips, ip)
+	}
+	var uris []*url.URL
+	for _, value := range san.URIs {
+		uri, err := url.Parse(value)
+		if err != nil || uri.Scheme == "" {
+			return nil, nil, fmt.Errorf("invalid URI: %s", value)
+		}
+		uris = append(uris, uri)
+	}
+	return ips, uris, nil
+}
+
+// CSRResult holds a PEM encoded PKCS#10 certificate signing request
+type CSRResult struct {
+	KeyLabel           string `json:"key_label"`
+	KeyID              string `json:"key_id"`
+	SignatureAlgorithm string `json:"signature_algorithm"`
+	PEM                string `json:"pem"`
+}
+
+// CreateCSR builds a PKCS#10 certificate signing request for the public key
+// of the pair and signs it with the private key on the token. RSA requests
+// are signed with SHA-256, EC requests with the hash matching the curve.
+func CreateCSR(provider string, slotID int, userPin string, keyLabel string, subject Subject, san SubjectAltNames) (*CSRResult, error) {
+	if subject.CommonName == "" && len(san.DNSNames) == 0 {
+		return nil, fmt.Errorf("a CommonName or at least one DNS name is required")
+	}
+	ips, uris, err := san.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := hsm.Open(provider, slotID, userPin)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	signer, err := signature.NewSessionSigner(s, keyLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.CertificateRequest{
+		Subject:        subject.Name(),
+		DNSNames:       san.DNSNames,
+		EmailAddresses: san.EmailAddresses,
+		IPAddresses:    ips,
+		URIs:           uris,
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate request: %w", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate request: %w", err)
+	}
+
+	return &CSRResult{
+		KeyLabel:           signer.Label(),
+		KeyID:              hex.EncodeToString(signer.KeyID()),
+		SignatureAlgorithm: csr.SignatureAlgorithm.String(),
+		PEM:                string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})),
+	}, nil
+}
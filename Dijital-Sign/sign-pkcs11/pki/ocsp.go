@@ -0,0 +1,213 @@
+package pki
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"log"
+	"os"
+	"sign-pkcs11/blockchain"
+	"sign-pkcs11/hsm"
+	"sign-pkcs11/signature"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// DefaultOCSPNextUpdate is how long OCSP responses are valid unless
+// OCSP_NEXT_UPDATE says otherwise
+const DefaultOCSPNextUpdate = time.Hour
+
+// OCSPResponder answers RFC 6960 status requests for certificates stored on
+// the token, using the ledger for revocation status. The responder key is
+// either a CA key itself or a key holding a delegated certificate with the
+// OCSP signing extended key usage, issued by the CA being queried.
+type OCSPResponder struct {
+	Provider   string
+	SlotID     int
+	UserPin    string
+	KeyLabel   string
+	NextUpdate time.Duration
+	bc         *blockchain.Blockchain
+}
+
+// NewOCSPResponder reads the responder settings from OCSP_PROVIDER,
+// OCSP_SLOT_ID, OCSP_USER_PIN, OCSP_KEY_LABEL and OCSP_NEXT_UPDATE. The
+// responder answers "unauthorized" until OCSP_KEY_LABEL is set.
+func NewOCSPResponder(bc *blockchain.Blockchain) (*OCSPResponder, error) {
+	r := &OCSPResponder{
+		Provider:   os.Getenv("OCSP_PROVIDER"),
+		UserPin:    os.Getenv("OCSP_USER_PIN"),
+		KeyLabel:   os.Getenv("OCSP_KEY_LABEL"),
+		NextUpdate: DefaultOCSPNextUpdate,
+		bc:         bc,
+	}
+	if v := os.Getenv("OCSP_SLOT_ID"); v != "" {
+		slotID, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OCSP_SLOT_ID: %w", err)
+		}
+		r.SlotID = slotID
+	}
+	if v := os.Getenv("OCSP_NEXT_UPDATE"); v != "" {
+		nextUpdate, err := time.ParseDuration(v)
+		if err != nil || nextUpdate <= 0 {
+			return nil, fmt.Errorf("invalid OCSP_NEXT_UPDATE: %s", v)
+		}
+		r.NextUpdate = nextUpdate
+	}
+	return r, nil
+}
+
+// Respond returns the DER encoded OCSP response for a DER encoded request.
+// Failures are reported with the matching OCSP error response, so the
+// result can always be sent to the client.
+func (r *OCSPResponder) Respond(requestDER []byte) []byte {
+	req, err := ocsp.ParseRequest(requestDER)
+	if err != nil {
+		return ocsp.MalformedRequestErrorResponse
+	}
+	if r.KeyLabel == "" {
+		return ocsp.UnauthorizedErrorResponse
+	}
+
+	response, err := r.respond(req)
+	if err != nil {
+		log.Printf("OCSP response for serial %s failed: %v", serialHex(req.SerialNumber), err)
+		return ocsp.InternalErrorErrorResponse
+	}
+	if response == nil {
+		return ocsp.UnauthorizedErrorResponse
+	}
+	return response
+}
+
+// respond signs the status of one certificate. It returns nil without an
+// error when the request names a CA this responder may not answer for.
+func (r *OCSPResponder) respond(req *ocsp.Request) ([]byte, error) {
+	s, err := hsm.Open(r.Provider, r.SlotID, r.UserPin)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	stored, err := findCertificates(s, nil)
+	if err != nil {
+		return nil, err
+	}
+	var issuer *x509.Certificate
+	for _, sc := range stored {
+		if sc.cert.IsCA && matchesIssuer(sc.cert, req) {
+			issuer = sc.cert
+			break
+		}
+	}
+	if issuer == nil {
+		return nil, nil
+	}
+
+	signer, err := signature.NewSessionSigner(s, r.KeyLabel)
+	if err != nil {
+		return nil, err
+	}
+	responderCert, err := responderCertificate(stored, signer, issuer)
+	if err != nil || responderCert == nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Minute)
+	template := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(r.NextUpdate),
+		IssuerHash:   req.HashAlgorithm,
+	}
+	if responderCert != issuer {
+		template.Certificate = responderCert
+	}
+
+	if _, err := issuedCertificate(s, issuer, serialHex(req.SerialNumber)); err == nil {
+		template.Status = ocsp.Good
+		issuerKeyID, err := subjectKeyID(issuer.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if record, revoked := Revocations(r.bc, issuerKeyID)[serialHex(req.SerialNumber)]; revoked {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = record.RevokedAt
+			template.RevocationReason = record.ReasonCode
+		}
+	}
+
+	response, err := ocsp.CreateResponse(issuer, responderCert, template, signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OCSP response: %w", err)
+	}
+	return response, nil
+}
+
+// responderCertificate picks the certificate the responder key signs with
+// for an issuer: the issuer itself when the responder key is the CA key,
+// otherwise a delegated OCSP signing certificate issued by it. It returns
+// nil when the key may not answer for the issuer.
+func responderCertificate(stored []storedCertificate, signer *signature.Signer, issuer *x509.Certificate) (*x509.Certificate, error) {
+	want, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode responder public key: %w", err)
+	}
+	if bytes.Equal(issuer.RawSubjectPublicKeyInfo, want) {
+		return issuer, nil
+	}
+
+	now := time.Now()
+	for _, sc := range stored {
+		cert := sc.cert
+		if !bytes.Equal(cert.RawSubjectPublicKeyInfo, want) || now.After(cert.NotAfter) || now.Before(cert.NotBefore) {
+			continue
+		}
+		if !hasExtKeyUsage(cert, x509.ExtKeyUsageOCSPSigning) || cert.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		return cert, nil
+	}
+	return nil, nil
+}
+
+// matchesIssuer reports whether the request's issuer name and key hashes
+// were computed from the certificate
+func matchesIssuer(cert *x509.Certificate, req *ocsp.Request) bool {
+	if req.HashAlgorithm == crypto.Hash(0) || !req.HashAlgorithm.Available() {
+		return false
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return false
+	}
+
+	h := req.HashAlgorithm.New()
+	h.Write(cert.RawSubject)
+	if !bytes.Equal(h.Sum(nil), req.IssuerNameHash) {
+		return false
+	}
+	h.Reset()
+	h.Write(spki.PublicKey.RightAlign())
+	return bytes.Equal(h.Sum(nil), req.IssuerKeyHash)
+}
+
+// hasExtKeyUsage reports whether the certificate lists the extended key usage
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
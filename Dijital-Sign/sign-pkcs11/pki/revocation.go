@@ -0,0 +1,288 @@
+package pki
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sign-pkcs11/blockchain"
+	"sign-pkcs11/hsm"
+	"sign-pkcs11/signature"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RevocationEvent is the event name of revocation records in the ledger
+const RevocationEvent = "certificate-revocation"
+
+// DefaultCRLNextUpdate is the CRL validity used when none is requested
+const DefaultCRLNextUpdate = 24 * time.Hour
+
+// ErrAlreadyRevoked is returned when a serial already has a revocation record
+var ErrAlreadyRevoked = errors.New("certificate is already revoked")
+
+// issuerLocks holds one mutex per CA subject key identifier. Revoke keeps
+// it from the already-revoked check until the record is in the ledger, so
+// concurrent requests cannot record the same serial twice.
+var (
+	issuerLocksMu sync.Mutex
+	issuerLocks   = map[string]*sync.Mutex{}
+)
+
+// revocationReasons maps the RFC 5280 CRLReason names accepted in requests
+// to their codes. certificateHold and removeFromCRL are left out since
+// ledger records cannot be withdrawn.
+var revocationReasons = map[string]int{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"cACompromise":         2,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+	"privilegeWithdrawn":   9,
+	"aACompromise":         10,
+}
+
+// RevocationRecord is the ledger entry written for a revoked certificate.
+// IssuerKeyID is the subject key identifier of the issuing CA, which tells
+// records of different CAs apart.
+type RevocationRecord struct {
+	Event       string    `json:"event"`
+	Serial      string    `json:"serial"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	IssuerKeyID string    `json:"issuer_key_id"`
+	Reason      string    `json:"reason"`
+	ReasonCode  int       `json:"reason_code"`
+	RevokedAt   time.Time `json:"revoked_at"`
+}
+
+// CRLResult holds a DER encoded certificate revocation list
+type CRLResult struct {
+	DER        []byte
+	Number     *big.Int
+	ThisUpdate time.Time
+	NextUpdate time.Time
+	Entries    int
+}
+
+// Revoke records the revocation of a certificate issued by the CA key in the
+// ledger. The record is signed with the CA key and the block references the
+// CA key's label. Revocations of one CA are serialised, so a serial is
+// recorded at most once.
+func Revoke(provider string, slotID int, userPin string, caLabel string, serial string, reason string, bc *blockchain.Blockchain) (*RevocationRecord, error) {
+	if serial == "" {
+		return nil, fmt.Errorf("Serial is required")
+	}
+	if reason == "" {
+		reason = "unspecified"
+	}
+	reasonCode, ok := revocationReasons[reason]
+	if !ok {
+		return nil, fmt.Errorf("unsupported revocation reason: %s", reason)
+	}
+
+	s, err := hsm.Open(provider, slotID, userPin)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	signer, ca, err := openCA(s, caLabel)
+	if err != nil {
+		return nil, err
+	}
+	issuerKeyID, err := subjectKeyID(ca.cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := issuedCertificate(s, ca.cert, serial)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := lockIssuer(issuerKeyID)
+	defer unlock()
+	if _, revoked := Revocations(bc, issuerKeyID)[serialHex(cert.SerialNumber)]; revoked {
+		return nil, ErrAlreadyRevoked
+	}
+
+	record := &RevocationRecord{
+		Event:       RevocationEvent,
+		Serial:      serialHex(cert.SerialNumber),
+		Subject:     cert.Subject.String(),
+		Issuer:      ca.cert.Subject.String(),
+		IssuerKeyID: hex.EncodeToString(issuerKeyID),
+		Reason:      reason,
+		ReasonCode:  reasonCode,
+		RevokedAt:   time.Now().UTC().Truncate(time.Second),
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode revocation record: %w", err)
+	}
+	signature, err := signRecord(signer, data)
+	if err != nil {
+		return nil, err
+	}
+	bc.AddKeyBlock(string(data), signature, signer.Label())
+	return record, nil
+}
+
+// lockIssuer locks the revocations of the CA with the given subject key
+// identifier and returns the matching unlock function
+func lockIssuer(issuerKeyID []byte) func() {
+	issuerLocksMu.Lock()
+	l, ok := issuerLocks[string(issuerKeyID)]
+	if !ok {
+		l = &sync.Mutex{}
+		issuerLocks[string(issuerKeyID)] = l
+	}
+	issuerLocksMu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// Revocations returns the ledger revocation records of the CA with the
+// given subject key identifier, keyed by hex serial
+func Revocations(bc *blockchain.Blockchain, issuerKeyID []byte) map[string]RevocationRecord {
+	want := hex.EncodeToString(issuerKeyID)
+	records := map[string]RevocationRecord{}
+	for _, block := range bc.ListData() {
+		if !strings.Contains(block.Data, RevocationEvent) {
+			continue
+		}
+		var record RevocationRecord
+		if err := json.Unmarshal([]byte(block.Data), &record); err != nil {
+			continue
+		}
+		if record.Event != RevocationEvent || record.IssuerKeyID != want {
+			continue
+		}
+		if _, seen := records[record.Serial]; !seen {
+			records[record.Serial] = record
+		}
+	}
+	return records
+}
+
+// CreateCRL builds a CRL of every certificate the CA key has revoked
+// according to the ledger, signed with the CA key. The CRL number is the
+// issuance time in seconds, which keeps it increasing across restarts.
+func CreateCRL(provider string, slotID int, userPin string, caLabel string, nextUpdate time.Duration, bc *blockchain.Blockchain) (*CRLResult, error) {
+	if nextUpdate < 0 {
+		return nil, fmt.Errorf("NextUpdate must not be negative")
+	}
+	if nextUpdate == 0 {
+		nextUpdate = DefaultCRLNextUpdate
+	}
+
+	s, err := hsm.Open(provider, slotID, userPin)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	signer, ca, err := openCA(s, caLabel)
+	if err != nil {
+		return nil, err
+	}
+	issuerKeyID, err := subjectKeyID(ca.cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []x509.RevocationListEntry
+	for _, record := range Revocations(bc, issuerKeyID) {
+		serial, ok := new(big.Int).SetString(record.Serial, 16)
+		if !ok {
+			continue
+		}
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: record.RevokedAt,
+			ReasonCode:     record.ReasonCode,
+		})
+	}
+
+	now := time.Now().UTC()
+	template := &x509.RevocationList{
+		Number:                    big.NewInt(now.Unix()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(nextUpdate),
+		RevokedCertificateEntries: entries,
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CRL: %w", err)
+	}
+	return &CRLResult{
+		DER:        der,
+		Number:     template.Number,
+		ThisUpdate: template.ThisUpdate,
+		NextUpdate: template.NextUpdate,
+		Entries:    len(entries),
+	}, nil
+}
+
+// openCA returns the signer and certificate of a CA key on the token
+func openCA(s *hsm.Session, caLabel string) (*signature.Signer, *storedCertificate, error) {
+	signer, err := signature.NewSessionSigner(s, caLabel)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := caCertificate(s, signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return signer, ca, nil
+}
+
+// issuedCertificate finds a stored certificate with the hex serial that was
+// signed by the CA certificate
+func issuedCertificate(s *hsm.Session, ca *x509.Certificate, serial string) (*x509.Certificate, error) {
+	want, err := normalizeSerial(serial)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := findCertificates(s, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, sc := range stored {
+		if serialHex(sc.cert.SerialNumber) != want {
+			continue
+		}
+		if bytes.Equal(sc.cert.RawIssuer, ca.RawSubject) && sc.cert.CheckSignatureFrom(ca) == nil {
+			return sc.cert, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no certificate with serial %s issued by %s", ErrCertificateNotFound, serial, ca.Subject)
+}
+
+// signRecord signs a ledger record with the token key and returns the hex
+// signature. Ed25519 keys sign the record itself, others its SHA-256 digest.
+func signRecord(signer *signature.Signer, data []byte) (string, error) {
+	var (
+		signature []byte
+		err       error
+	)
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		signature, err = signer.Sign(rand.Reader, data, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(data)
+		signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(signature), nil
+}
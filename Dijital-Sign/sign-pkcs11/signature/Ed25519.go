@@ -0,0 +1,104 @@
+package signature
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sign-pkcs11/hsm"
+
+	pkcs11 "github.com/miekg/pkcs11"
+)
+
+// Ed25519SignStr mesajı HSM üzerindeki Ed25519 özel anahtarı ile imzalar.
+// Ed25519 mesajın kendisini imzalar, önceden hash'lemeye gerek yoktur.
+// Bağlantı koptuğunda yeniden bağlanılıp tekrarlanır; HA grubunda diğer
+// üyede denenir.
+func Ed25519SignStr(provider string, slotID int, pin string, keyLabel string, keyIDHex string, Signauture string) (string, error) {
+	var result string
+	err := hsm.Failover(provider, slotID, func(provider string, slotID int) (err error) {
+		result, err = ed25519Sign(provider, slotID, pin, keyLabel, keyIDHex, Signauture)
+		return err
+	})
+	return result, err
+}
+
+// ed25519Sign Ed25519SignStr işlemini tek bir slot üzerinde yapar
+func ed25519Sign(provider string, slotID int, pin string, keyLabel string, keyIDHex string, Signauture string) (string, error) {
+	keyID, err := decodeKeyID(keyIDHex)
+	if err != nil {
+		return "", err
+	}
+
+	p, session, closeSession, err := openSession(provider, slotID, pin)
+	if err != nil {
+		return "", err
+	}
+	defer closeSession()
+
+	keyHandle, err := findSigningKey(p, session, keyLabel, keyID)
+	if err != nil {
+		return "", err
+	}
+	if err := checkMechanism(provider, slotID, p, session, keyHandle, hsm.CKM_EDDSA, pkcs11.CKF_SIGN); err != nil {
+		return "", err
+	}
+
+	err = p.SignInit(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(hsm.CKM_EDDSA, nil)}, keyHandle)
+	if err != nil {
+		return "", fmt.Errorf("SignInit hatası: %w", err)
+	}
+
+	signature, err := p.Sign(session, []byte(Signauture))
+	if err != nil {
+		return "", fmt.Errorf("Sign hatası: %w", err)
+	}
+
+	// İmzayı hex formatında döndür
+	return hex.EncodeToString(signature), nil
+}
+
+// Ed25519VerifyStr hex formatındaki Ed25519 imzasını HSM üzerindeki public key ile doğrular.
+// Bağlantı koptuğunda yeniden bağlanılıp tekrarlanır; HA grubunda diğer üyede denenir.
+func Ed25519VerifyStr(provider string, slotID int, pin string, keyLabel string, keyIDHex string, Signauture string, signatureHex string) (string, error) {
+	var result string
+	err := hsm.Failover(provider, slotID, func(provider string, slotID int) (err error) {
+		result, err = ed25519Verify(provider, slotID, pin, keyLabel, keyIDHex, Signauture, signatureHex)
+		return err
+	})
+	return result, err
+}
+
+// ed25519Verify Ed25519VerifyStr işlemini tek bir slot üzerinde yapar
+func ed25519Verify(provider string, slotID int, pin string, keyLabel string, keyIDHex string, Signauture string, signatureHex string) (string, error) {
+	keyID, err := decodeKeyID(keyIDHex)
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := hex.DecodeString(signatureHex)
+	if err != nil {
+		return "", fmt.Errorf("İmza hex decode hatası: %w", err)
+	}
+
+	p, session, closeSession, err := openSession(provider, slotID, pin)
+	if err != nil {
+		return "", err
+	}
+	defer closeSession()
+
+	pubKeyHandles, err := findVerifyKeys(p, session, keyLabel, keyID)
+	if err != nil {
+		return "", err
+	}
+	if err := checkMechanism(provider, slotID, p, session, pubKeyHandles[0], hsm.CKM_EDDSA, pkcs11.CKF_VERIFY); err != nil {
+		return "", err
+	}
+
+	ok, err := verifyAny(p, session, pkcs11.NewMechanism(hsm.CKM_EDDSA, nil), pubKeyHandles, []byte(Signauture), signature)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "Doğrulama başarısız", nil
+	}
+	return "Doğrulama başarılı", nil
+}
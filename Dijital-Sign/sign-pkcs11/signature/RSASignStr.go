@@ -4,65 +4,45 @@ import (
     "crypto/sha256"
     "encoding/hex"
     "fmt"
-    "os"
+    "sign-pkcs11/hsm"
 
     pkcs11 "github.com/miekg/pkcs11"
 )
 
-func RSASignStr(slotID int, pin string, keyLabel string, Signauture string) (string, error) {
-    libraryPath := os.Getenv("PKCS11_LIB")
-
-    p := pkcs11.New(libraryPath)
-    if p == nil {
-        return "", fmt.Errorf("PKCS#11 kütüphanesi yüklenemedi")
-    }
-
-    err := p.Initialize()
-    if err != nil {
-        return "", fmt.Errorf("Initialize hatası: %v", err)
-    }
-    defer p.Finalize()
+// RSASignStr mesajı label ve/veya CKA_ID ile bulunan RSA özel anahtarı ile imzalar.
+// İmzalama token üzerinde değişiklik yapmadığından bağlantı koptuğunda yeniden
+// bağlanılıp tekrarlanır; HA grubunda diğer üyede denenir.
+func RSASignStr(provider string, slotID int, pin string, keyLabel string, keyIDHex string, Signauture string) (string, error) {
+    var result string
+    err := hsm.Failover(provider, slotID, func(provider string, slotID int) (err error) {
+        result, err = rsaSign(provider, slotID, pin, keyLabel, keyIDHex, Signauture)
+        return err
+    })
+    return result, err
+}
 
-    session, err := p.OpenSession(uint(slotID), pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+// rsaSign RSASignStr işlemini tek bir slot üzerinde yapar
+func rsaSign(provider string, slotID int, pin string, keyLabel string, keyIDHex string, Signauture string) (string, error) {
+    keyID, err := decodeKeyID(keyIDHex)
     if err != nil {
-        return "", fmt.Errorf("OpenSession hatası: %v", err)
+        return "", err
     }
-    defer p.CloseSession(session)
 
-    err = p.Login(session, pkcs11.CKU_USER, pin)
+    p, session, closeSession, err := openSession(provider, slotID, pin)
     if err != nil {
-        return "", fmt.Errorf("Login hatası: %v", err)
+        return "", err
     }
-    defer p.Logout(session)
+    defer closeSession()
 
     // Özel anahtarı bul
-    template := []*pkcs11.Attribute{
-        pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel),
-        pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
-    }
-
-    err = p.FindObjectsInit(session, template)
+    keyHandle, err := findSigningKey(p, session, keyLabel, keyID)
     if err != nil {
-        return "", fmt.Errorf("FindObjectsInit hatası: %v", err)
+        return "", err
     }
-
-    objs, _, err := p.FindObjects(session, 1)
-    if err != nil {
-        p.FindObjectsFinal(session)
-        return "", fmt.Errorf("FindObjects hatası: %v", err)
-    }
-
-    err = p.FindObjectsFinal(session)
-    if err != nil {
-        return "", fmt.Errorf("FindObjectsFinal hatası: %v", err)
-    }
-
-    if len(objs) == 0 {
-        return "", fmt.Errorf("Belirtilen label ile anahtar bulunamadı")
+    if err := checkMechanism(provider, slotID, p, session, keyHandle, pkcs11.CKM_RSA_PKCS, pkcs11.CKF_SIGN); err != nil {
+        return "", err
     }
 
-    keyHandle := objs[0]
-
     // Mesajı imzala
     message := []byte(Signauture)
     hash := sha256.Sum256(message)
@@ -79,12 +59,12 @@ func RSASignStr(slotID int, pin string, keyLabel string, Signauture string) (str
 
     err = p.SignInit(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)}, keyHandle)
     if err != nil {
-        return "", fmt.Errorf("SignInit hatası: %v", err)
+        return "", fmt.Errorf("SignInit hatası: %w", err)
     }
 
     signature, err := p.Sign(session, dataToSign)
     if err != nil {
-        return "", fmt.Errorf("Sign hatası: %v", err)
+        return "", fmt.Errorf("Sign hatası: %w", err)
     }
 
     // İmzayı hex formatında döndür
@@ -92,7 +72,7 @@ func RSASignStr(slotID int, pin string, keyLabel string, Signauture string) (str
 }
 
 // func main() {
-//     sig, err := RSASignStr(0, "1111", "RSAKey3_priv", "Hello World")
+//     sig, err := RSASignStr(0, "1111", "RSAKey3_priv", "", "Hello World")
 //     if err != nil {
 //         fmt.Printf("İmzalama hatası: %v\n", err)
 //         os.Exit(1)
@@ -0,0 +1,62 @@
+package signature
+
+import (
+	"fmt"
+	"os"
+	"sign-pkcs11/create"
+	"sign-pkcs11/hsm"
+	"sign-pkcs11/keys"
+	"testing"
+	"time"
+)
+
+// TestRotatedSigningKeyIntegration rotasyondan sonra temel label'ın ve eski
+// "_priv" label'ının imzalamaya açık yeni sürüme çözüldüğünü gerçek bir
+// token üzerinde (örneğin SoftHSM) kontrol eder:
+//
+//	PKCS11_LIB=/usr/lib/softhsm/libsofthsm2.so PKCS11_PIN=1234 go test ./signature
+//
+// PKCS11_LIB yoksa test atlanır.
+func TestRotatedSigningKeyIntegration(t *testing.T) {
+	if os.Getenv("PKCS11_LIB") == "" {
+		t.Skip("PKCS11_LIB is not set")
+	}
+	pin := os.Getenv("PKCS11_PIN")
+	if pin == "" {
+		t.Fatal("PKCS11_PIN must be set with PKCS11_LIB")
+	}
+	t.Cleanup(hsm.Shutdown)
+	slotID, err := hsm.DefaultSlot("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := fmt.Sprintf("itest-%d", time.Now().UnixNano())
+	if _, err := create.GenerateRSAKey("", slotID, pin, 2048, base, "", ""); err != nil {
+		t.Fatalf("GenerateRSAKey: %v", err)
+	}
+	t.Cleanup(func() {
+		for _, label := range []string{base, keys.VersionLabel(base, 1)} {
+			if _, err := keys.DeleteKeyPair("", slotID, pin, label, "", false, true, nil); err != nil {
+				t.Errorf("DeleteKeyPair(%s): %v", label, err)
+			}
+		}
+	})
+	if _, err := keys.RotateKey("", slotID, pin, base, "", nil); err != nil {
+		t.Fatalf("RotateKey: %v", err)
+	}
+
+	for _, label := range []string{base, base + "_priv"} {
+		if _, err := RSASignStr("", slotID, pin, label, "", "message"); err != nil {
+			t.Errorf("RSASignStr(%s) after rotation: %v", label, err)
+		}
+		signer, err := NewSigner("", slotID, pin, label)
+		if err != nil {
+			t.Errorf("NewSigner(%s): %v", label, err)
+			continue
+		}
+		if signer.Label() != base+"-v1_priv" {
+			t.Errorf("NewSigner(%s) resolved to %s, want %s-v1_priv", label, signer.Label(), base)
+		}
+	}
+}
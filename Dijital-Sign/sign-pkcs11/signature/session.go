@@ -0,0 +1,170 @@
+package signature
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sign-pkcs11/hsm"
+	"sign-pkcs11/keys"
+
+	pkcs11 "github.com/miekg/pkcs11"
+)
+
+// errKeyNotFound label/ID ile eşleşen anahtar bulunamadığında döner;
+// keys.ErrKeyNotFound'u sarar
+var errKeyNotFound = fmt.Errorf("Belirtilen label/ID ile anahtar bulunamadı: %w", keys.ErrKeyNotFound)
+
+// openSession paylaşılan oturum havuzundan slot üzerinde giriş yapılmış bir
+// oturum alır. Dönen fonksiyon oturumu havuza geri verir; çağıran tarafından
+// defer edilmelidir.
+func openSession(provider string, slotID int, pin string) (*pkcs11.Ctx, pkcs11.SessionHandle, func(), error) {
+	s, err := hsm.Open(provider, slotID, pin)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("Oturum açılamadı: %w", err)
+	}
+	return s.Ctx, s.Handle, s.Close, nil
+}
+
+// findKey verilen sınıftaki anahtarı label ve/veya CKA_ID ile bulur.
+// İkisi birden verilirse anahtarın her ikisiyle de eşleşmesi gerekir.
+func findKey(p *pkcs11.Ctx, session pkcs11.SessionHandle, class uint, keyLabel string, keyID []byte) (pkcs11.ObjectHandle, error) {
+	if keyLabel == "" && len(keyID) == 0 {
+		return 0, fmt.Errorf("KeyLabel veya KeyId belirtilmelidir")
+	}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+	}
+	if keyLabel != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel))
+	}
+	if len(keyID) > 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, keyID))
+	}
+
+	if err := p.FindObjectsInit(session, template); err != nil {
+		return 0, fmt.Errorf("FindObjectsInit hatası: %w", err)
+	}
+
+	objs, _, err := p.FindObjects(session, 1)
+	if err != nil {
+		p.FindObjectsFinal(session)
+		return 0, fmt.Errorf("FindObjects hatası: %w", err)
+	}
+
+	if err := p.FindObjectsFinal(session); err != nil {
+		return 0, fmt.Errorf("FindObjectsFinal hatası: %w", err)
+	}
+
+	if len(objs) == 0 {
+		return 0, errKeyNotFound
+	}
+
+	return objs[0], nil
+}
+
+// findSigningKey imzalama için özel anahtarı bulur. Yalnız label verilmişse
+// label activeKey ile çözülür; rotasyonu yapılmış bir anahtarda "_priv"
+// son ekli label da imzalamaya açık en yeni sürüme yönlenir. Sürümü
+// olmayan label'lar ve CKA_ID verilen istekler birebir eşleşmeyle aranır.
+func findSigningKey(p *pkcs11.Ctx, session pkcs11.SessionHandle, keyLabel string, keyID []byte) (pkcs11.ObjectHandle, error) {
+	if keyLabel != "" && len(keyID) == 0 {
+		handle, ok, err := activeKey(&hsm.Session{Ctx: p, Handle: session}, keyLabel)
+		if ok || err != nil {
+			return handle, err
+		}
+	}
+	return findKey(p, session, pkcs11.CKO_PRIVATE_KEY, keyLabel, keyID)
+}
+
+// activeKey label'ı keys.BaseLabel ile temel label'a indirger ve temel
+// label'ın sürümleri (<label>_priv, <label>-v<N>_priv) varsa imzalamaya
+// açık en yeni sürümü döndürür. Rotasyonda CKA_SIGN'i kapatılan eski
+// sürümler label'larıyla seçilemez. Sürüm yoksa ok false döner.
+func activeKey(s *hsm.Session, keyLabel string) (handle pkcs11.ObjectHandle, ok bool, err error) {
+	base := keys.BaseLabel(keyLabel)
+	versions, err := keys.Versions(s, base, pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(versions) == 0 {
+		return 0, false, nil
+	}
+	active, err := keys.ActiveVersion(s, base)
+	if err != nil {
+		return 0, true, fmt.Errorf("Özel anahtar %s: %w", keyLabel, err)
+	}
+	return active.Handle, true, nil
+}
+
+// findVerifyKeys doğrulama için public key'leri bulur. Label ile birebir
+// eşleşen anahtar yoksa temel label'ın tüm sürümleri en yeniden eskiye
+// döndürülür; eski sürümlerle atılmış imzalar da doğrulanabilir.
+func findVerifyKeys(p *pkcs11.Ctx, session pkcs11.SessionHandle, keyLabel string, keyID []byte) ([]pkcs11.ObjectHandle, error) {
+	handle, err := findKey(p, session, pkcs11.CKO_PUBLIC_KEY, keyLabel, keyID)
+	if err == nil {
+		return []pkcs11.ObjectHandle{handle}, nil
+	}
+	if !errors.Is(err, errKeyNotFound) || keyLabel == "" || len(keyID) > 0 {
+		return nil, err
+	}
+
+	versions, verr := keys.Versions(&hsm.Session{Ctx: p, Handle: session}, keyLabel, pkcs11.CKO_PUBLIC_KEY)
+	if verr != nil || len(versions) == 0 {
+		return nil, err
+	}
+	handles := make([]pkcs11.ObjectHandle, 0, len(versions))
+	for _, v := range versions {
+		handles = append(handles, v.Handle)
+	}
+	return handles, nil
+}
+
+// checkMechanism mekanizmanın slot üzerinde istenen işlem için desteklendiğini
+// C_GetMechanismInfo ile kontrol eder; RSA anahtarlarında modulus boyutu da
+// desteklenen aralıkla karşılaştırılır
+func checkMechanism(provider string, slotID int, p *pkcs11.Ctx, session pkcs11.SessionHandle, handle pkcs11.ObjectHandle, mechanism uint, operation uint) error {
+	var keySize uint
+	if mechanism == pkcs11.CKM_RSA_PKCS {
+		s := &hsm.Session{Ctx: p, Handle: session, SlotID: slotID, Provider: provider}
+		if modulus, err := s.Attribute(handle, pkcs11.CKA_MODULUS); err == nil {
+			keySize = uint(len(modulus)) * 8
+		}
+	}
+	return hsm.CheckMechanism(provider, slotID, mechanism, operation, keySize)
+}
+
+// verifyAny imzayı verilen anahtarlarla sırayla doğrular; biri başarılı olursa
+// true döner. Yalnızca CKR_SIGNATURE_INVALID ve CKR_SIGNATURE_LEN_RANGE "bu
+// anahtar eşleşmedi" sayılır ve sıradaki anahtar denenir; diğer hatalar
+// (cihaz/oturum kaybı, CKR_DATA_LEN_RANGE vb.) sarılarak döndürülür.
+func verifyAny(p *pkcs11.Ctx, session pkcs11.SessionHandle, mechanism *pkcs11.Mechanism, handles []pkcs11.ObjectHandle, data []byte, signature []byte) (bool, error) {
+	for _, handle := range handles {
+		if err := p.VerifyInit(session, []*pkcs11.Mechanism{mechanism}, handle); err != nil {
+			return false, fmt.Errorf("VerifyInit hatası: %w", err)
+		}
+		err := p.Verify(session, data, signature)
+		switch {
+		case err == nil:
+			return true, nil
+		case errors.Is(err, pkcs11.Error(pkcs11.CKR_SIGNATURE_INVALID)),
+			errors.Is(err, pkcs11.Error(pkcs11.CKR_SIGNATURE_LEN_RANGE)):
+			continue
+		default:
+			return false, fmt.Errorf("Verify hatası: %w", err)
+		}
+	}
+	return false, nil
+}
+
+// decodeKeyID hex formatındaki CKA_ID değerini çözer; boş değer "ID yok" demektir
+func decodeKeyID(keyIDHex string) ([]byte, error) {
+	if keyIDHex == "" {
+		return nil, nil
+	}
+	keyID, err := hex.DecodeString(keyIDHex)
+	if err != nil {
+		return nil, fmt.Errorf("KeyId hex decode hatası: %w", err)
+	}
+	return keyID, nil
+}
@@ -0,0 +1,412 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sign-pkcs11/hsm"
+	"sign-pkcs11/keys"
+	"strings"
+	"sync"
+
+	pkcs11 "github.com/miekg/pkcs11"
+)
+
+// hashOIDs PKCS#1 v1.5 DigestInfo yapısında kullanılan özet algoritması
+// OID'leri (RFC 8017, Appendix A.2.4)
+var hashOIDs = map[crypto.Hash]asn1.ObjectIdentifier{
+	crypto.MD5:        {1, 2, 840, 113549, 2, 5},
+	crypto.SHA1:       {1, 3, 14, 3, 2, 26},
+	crypto.RIPEMD160:  {1, 3, 36, 3, 2, 1},
+	crypto.SHA224:     {2, 16, 840, 1, 101, 3, 4, 2, 4},
+	crypto.SHA256:     {2, 16, 840, 1, 101, 3, 4, 2, 1},
+	crypto.SHA384:     {2, 16, 840, 1, 101, 3, 4, 2, 2},
+	crypto.SHA512:     {2, 16, 840, 1, 101, 3, 4, 2, 3},
+	crypto.SHA512_224: {2, 16, 840, 1, 101, 3, 4, 2, 5},
+	crypto.SHA512_256: {2, 16, 840, 1, 101, 3, 4, 2, 6},
+	crypto.SHA3_224:   {2, 16, 840, 1, 101, 3, 4, 2, 7},
+	crypto.SHA3_256:   {2, 16, 840, 1, 101, 3, 4, 2, 8},
+	crypto.SHA3_384:   {2, 16, 840, 1, 101, 3, 4, 2, 9},
+	crypto.SHA3_512:   {2, 16, 840, 1, 101, 3, 4, 2, 10},
+}
+
+// hashMechanisms PSS ve OAEP parametrelerinde kullanılan özet mekanizması ve
+// MGF1 fonksiyonu
+var hashMechanisms = map[crypto.Hash]struct{ hash, mgf uint }{
+	crypto.SHA1:     {pkcs11.CKM_SHA_1, pkcs11.CKG_MGF1_SHA1},
+	crypto.SHA224:   {pkcs11.CKM_SHA224, pkcs11.CKG_MGF1_SHA224},
+	crypto.SHA256:   {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384:   {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512:   {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+	crypto.SHA3_224: {pkcs11.CKM_SHA3_224, hsm.CKG_MGF1_SHA3_224},
+	crypto.SHA3_256: {pkcs11.CKM_SHA3_256, hsm.CKG_MGF1_SHA3_256},
+	crypto.SHA3_384: {pkcs11.CKM_SHA3_384, hsm.CKG_MGF1_SHA3_384},
+	crypto.SHA3_512: {pkcs11.CKM_SHA3_512, hsm.CKG_MGF1_SHA3_512},
+}
+
+// Signer HSM üzerindeki bir özel anahtarı crypto.Signer ve RSA anahtarlarında
+// crypto.Decrypter olarak sunar. NewSigner ile oluşturulan Signer oturum
+// tutmaz: her işlem havuzdan bir oturum ödünç alır ve bitince geri verir,
+// oturum ya da cihaz kaybolursa yeniden bağlanıp işlemi tekrarlar. Aynı
+// Signer birden fazla goroutine'den kullanılabilir.
+type Signer struct {
+	provider string
+	slotID   int
+	pin      string
+	label    string
+	keyID    []byte
+	pub      crypto.PublicKey
+
+	// NewSessionSigner ile çağıranın oturumu kullanılır; işlemler mu ile
+	// sıraya sokulur
+	mu     sync.Mutex
+	s      *hsm.Session
+	handle pkcs11.ObjectHandle
+}
+
+var (
+	_ crypto.Signer    = (*Signer)(nil)
+	_ crypto.Decrypter = (*Signer)(nil)
+)
+
+// NewSigner slot üzerindeki anahtarı çözer, public key'ini okur ve Signer
+// döndürür. Oturum yalnızca bu okuma ve sonraki her işlem süresince tutulur.
+func NewSigner(provider string, slotID int, pin string, keyLabel string) (*Signer, error) {
+	if keyLabel == "" {
+		return nil, fmt.Errorf("KeyLabel belirtilmelidir")
+	}
+	k := &Signer{provider: provider, slotID: slotID, pin: pin}
+	err := hsm.Failover(provider, slotID, func(provider string, slotID int) error {
+		s, err := hsm.Open(provider, slotID, pin)
+		if err != nil {
+			return fmt.Errorf("Oturum açılamadı: %w", err)
+		}
+		defer s.Close()
+		_, err = k.load(s, keyLabel)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// NewSessionSigner açık bir oturum üzerinde Signer döndürür; oturum çağıranda
+// kalır ve kapatıldıktan sonra Signer kullanılamaz. Label "_priv" label'ı,
+// üretilmiş bir anahtar çiftinin temel label'ı ya da rotasyonu yapılmış bir
+// anahtarın temel label'ı olabilir; sonuncusunda etkin sürüm kullanılır.
+func NewSessionSigner(s *hsm.Session, keyLabel string) (*Signer, error) {
+	if keyLabel == "" {
+		return nil, fmt.Errorf("KeyLabel belirtilmelidir")
+	}
+	k := &Signer{provider: s.Provider, slotID: s.SlotID, s: s}
+	handle, err := k.load(s, keyLabel)
+	if err != nil {
+		return nil, err
+	}
+	k.handle = handle
+	return k, nil
+}
+
+// load label'ı özel anahtara çözer; anahtarın label'ını, CKA_ID'sini ve
+// public key'ini Signer'a yazar
+func (k *Signer) load(s *hsm.Session, keyLabel string) (pkcs11.ObjectHandle, error) {
+	handle, err := findPrivateKey(s, keyLabel)
+	if err != nil {
+		return 0, err
+	}
+	k.label = keyLabel
+	if v, err := s.Attribute(handle, pkcs11.CKA_LABEL); err == nil {
+		k.label = string(v)
+	}
+	if v, err := s.Attribute(handle, pkcs11.CKA_ID); err == nil {
+		k.keyID = v
+	}
+
+	// EC özel anahtarlarında CKA_EC_POINT bulunmaz; çiftin public key
+	// objesi okunur, bulunamazsa açık bileşenleri özel anahtarda tutan
+	// token'lar için özel anahtara dönülür
+	pubHandle := handle
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, strings.TrimSuffix(k.label, "_priv")+"_pub"),
+	}
+	if len(k.keyID) > 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, k.keyID))
+	}
+	if handles, err := s.FindObjects(template); err == nil && len(handles) > 0 {
+		pubHandle = handles[0]
+	}
+	k.pub, err = s.PublicKey(pubHandle)
+	if err != nil {
+		return 0, err
+	}
+	return handle, nil
+}
+
+// do fn'i bir oturum ve özel anahtar handle'ı ile çalıştırır. NewSigner
+// Signer'larında oturum her çağrıda havuzdan alınır ve anahtar label'ından
+// yeniden bulunur; imzalama ve şifre çözme token'da bir şey değiştirmediği
+// için yeniden bağlanma ya da HA üyesi değişiminden sonra tekrarlanır.
+func (k *Signer) do(fn func(s *hsm.Session, handle pkcs11.ObjectHandle) error) error {
+	if k.s != nil {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		return fn(k.s, k.handle)
+	}
+	return hsm.Failover(k.provider, k.slotID, func(provider string, slotID int) error {
+		s, err := hsm.Open(provider, slotID, k.pin)
+		if err != nil {
+			return fmt.Errorf("Oturum açılamadı: %w", err)
+		}
+		defer s.Close()
+		handle, err := findPrivateKey(s, k.label)
+		if err != nil {
+			return err
+		}
+		return fn(s, handle)
+	})
+}
+
+// findPrivateKey label'ı özel anahtar objesine çözer; sürümlü anahtarlar
+// activeKey ile, diğerleri birebir label eşleşmesiyle bulunur
+func findPrivateKey(s *hsm.Session, keyLabel string) (pkcs11.ObjectHandle, error) {
+	handle, ok, err := activeKey(s, keyLabel)
+	if ok || err != nil {
+		return handle, err
+	}
+
+	handles, err := s.FindObjects([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(handles) == 0 {
+		return 0, fmt.Errorf("Özel anahtar %s: %w", keyLabel, keys.ErrKeyNotFound)
+	}
+	return handles[0], nil
+}
+
+// Public anahtar çiftinin public key'ini döndürür
+func (k *Signer) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// Label özel anahtarın CKA_LABEL değerini döndürür
+func (k *Signer) Label() string {
+	return k.label
+}
+
+// KeyID özel anahtarın CKA_ID değerini döndürür
+func (k *Signer) KeyID() []byte {
+	return k.keyID
+}
+
+// Sign özeti RSA anahtarlarında CKM_RSA_PKCS (opts *rsa.PSSOptions ise
+// CKM_RSA_PKCS_PSS), EC anahtarlarında CKM_ECDSA ile imzalar. Ed25519
+// anahtarlarında özet değil mesajın kendisi CKM_EDDSA ile imzalanır. ECDSA
+// imzaları ASN.1 DER olarak döner.
+func (k *Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash := opts.HashFunc()
+	if hash != crypto.Hash(0) && len(digest) != hash.Size() {
+		return nil, fmt.Errorf("Özet uzunluğu %v için %d bayt olmalıdır, %d bayt verildi", hash, hash.Size(), len(digest))
+	}
+
+	var (
+		mechanism *pkcs11.Mechanism
+		data      = digest
+	)
+	switch pub := k.pub.(type) {
+	case *rsa.PublicKey:
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			params, err := pssParams(pub, hash, pss.SaltLength)
+			if err != nil {
+				return nil, err
+			}
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, params)
+			break
+		}
+		prefixed, err := digestInfo(hash, digest)
+		if err != nil {
+			return nil, err
+		}
+		mechanism, data = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil), prefixed
+	case *ecdsa.PublicKey:
+		// Özet eğri derecesinden uzunsa ECDSA'daki gibi kırpılır
+		if size := (pub.Curve.Params().N.BitLen() + 7) / 8; len(data) > size {
+			data = data[:size]
+		}
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+	case ed25519.PublicKey:
+		if hash != crypto.Hash(0) {
+			return nil, fmt.Errorf("Ed25519 özeti değil mesajın kendisini imzalar")
+		}
+		mechanism = pkcs11.NewMechanism(hsm.CKM_EDDSA, nil)
+	default:
+		return nil, fmt.Errorf("Desteklenmeyen anahtar tipi %T", k.pub)
+	}
+
+	var signature []byte
+	err := k.do(func(s *hsm.Session, handle pkcs11.ObjectHandle) error {
+		if err := hsm.CheckMechanism(s.Provider, s.SlotID, mechanism.Mechanism, pkcs11.CKF_SIGN, k.keySize()); err != nil {
+			return err
+		}
+		if err := s.Ctx.SignInit(s.Handle, []*pkcs11.Mechanism{mechanism}, handle); err != nil {
+			return fmt.Errorf("SignInit hatası: %w", err)
+		}
+		var err error
+		signature, err = s.Ctx.Sign(s.Handle, data)
+		if err != nil {
+			return fmt.Errorf("Sign hatası: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if mechanism.Mechanism == pkcs11.CKM_ECDSA {
+		return ecdsaSignatureDER(signature)
+	}
+	return signature, nil
+}
+
+// Decrypt RSA ile şifrelenmiş veriyi çözer. opts nil ya da
+// *rsa.PKCS1v15DecryptOptions ise CKM_RSA_PKCS, *rsa.OAEPOptions ise
+// CKM_RSA_PKCS_OAEP kullanılır. SessionKeyLen verilmişse çözme hatasında
+// crypto/rsa'daki gibi rastgele bir anahtar döner, böylece hata dışarıdan
+// ayırt edilemez.
+func (k *Signer) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if _, ok := k.pub.(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("Şifre çözme yalnızca RSA anahtarlarında desteklenir")
+	}
+
+	var (
+		mechanism     *pkcs11.Mechanism
+		sessionKeyLen int
+	)
+	switch o := opts.(type) {
+	case nil:
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+	case *rsa.PKCS1v15DecryptOptions:
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+		sessionKeyLen = o.SessionKeyLen
+	case *rsa.OAEPOptions:
+		mgfHash := o.MGFHash
+		if mgfHash == crypto.Hash(0) {
+			mgfHash = o.Hash
+		}
+		h, ok := hashMechanisms[o.Hash]
+		m, mok := hashMechanisms[mgfHash]
+		if !ok || !mok {
+			return nil, fmt.Errorf("OAEP için desteklenmeyen özet fonksiyonu %v", o.Hash)
+		}
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, pkcs11.NewOAEPParams(h.hash, m.mgf, pkcs11.CKZ_DATA_SPECIFIED, o.Label))
+	default:
+		return nil, fmt.Errorf("Desteklenmeyen şifre çözme seçenekleri %T", opts)
+	}
+
+	var plaintext []byte
+	err := k.do(func(s *hsm.Session, handle pkcs11.ObjectHandle) error {
+		if err := hsm.CheckMechanism(s.Provider, s.SlotID, mechanism.Mechanism, pkcs11.CKF_DECRYPT, k.keySize()); err != nil {
+			return err
+		}
+		var err error
+		plaintext, err = decrypt(s, handle, mechanism, msg)
+		return err
+	})
+	if sessionKeyLen == 0 {
+		return plaintext, err
+	}
+
+	// Hata ya da beklenmeyen uzunluk rastgele anahtarla gizlenir
+	key := make([]byte, sessionKeyLen)
+	if _, rerr := io.ReadFull(rand, key); rerr != nil {
+		return nil, rerr
+	}
+	if err == nil && len(plaintext) == sessionKeyLen {
+		subtle.ConstantTimeCopy(1, key, plaintext)
+	}
+	return key, nil
+}
+
+// decrypt C_DecryptInit ve C_Decrypt çağrılarını yapar
+func decrypt(s *hsm.Session, handle pkcs11.ObjectHandle, mechanism *pkcs11.Mechanism, msg []byte) ([]byte, error) {
+	if err := s.Ctx.DecryptInit(s.Handle, []*pkcs11.Mechanism{mechanism}, handle); err != nil {
+		return nil, fmt.Errorf("DecryptInit hatası: %w", err)
+	}
+	plaintext, err := s.Ctx.Decrypt(s.Handle, msg)
+	if err != nil {
+		return nil, fmt.Errorf("Decrypt hatası: %w", err)
+	}
+	return plaintext, nil
+}
+
+// keySize RSA anahtarlarında modulus uzunluğunu bit olarak döndürür; diğer
+// anahtarlarda 0 döner ve boyut kontrol edilmez
+func (k *Signer) keySize() uint {
+	if pub, ok := k.pub.(*rsa.PublicKey); ok {
+		return uint(pub.N.BitLen())
+	}
+	return 0
+}
+
+// digestInfo özeti CKM_RSA_PKCS için DER DigestInfo yapısına sarar. Özet
+// fonksiyonu verilmemişse (crypto.Hash(0)) ya da MD5SHA1 ise veri olduğu gibi
+// imzalanır.
+func digestInfo(hash crypto.Hash, digest []byte) ([]byte, error) {
+	if hash == crypto.Hash(0) || hash == crypto.MD5SHA1 {
+		return digest, nil
+	}
+	oid, ok := hashOIDs[hash]
+	if !ok {
+		return nil, fmt.Errorf("PKCS#1 v1.5 için desteklenmeyen özet fonksiyonu %v", hash)
+	}
+	return asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		Digest    []byte
+	}{pkix.AlgorithmIdentifier{Algorithm: oid, Parameters: asn1.NullRawValue}, digest})
+}
+
+// pssParams CKM_RSA_PKCS_PSS parametrelerini oluşturur. Tuz uzunluğu
+// crypto/rsa'daki gibi yorumlanır: PSSSaltLengthAuto mümkün olan en uzun
+// tuzu, PSSSaltLengthEqualsHash özet uzunluğunu seçer.
+func pssParams(pub *rsa.PublicKey, hash crypto.Hash, saltLength int) ([]byte, error) {
+	h, ok := hashMechanisms[hash]
+	if !ok {
+		return nil, fmt.Errorf("PSS için desteklenmeyen özet fonksiyonu %v", hash)
+	}
+	switch saltLength {
+	case rsa.PSSSaltLengthAuto:
+		saltLength = (pub.N.BitLen()-1+7)/8 - 2 - hash.Size()
+	case rsa.PSSSaltLengthEqualsHash:
+		saltLength = hash.Size()
+	}
+	if saltLength < 0 {
+		return nil, errors.New("PSS tuz uzunluğu anahtar için fazla uzun")
+	}
+	return pkcs11.NewPSSParams(h.hash, h.mgf, uint(saltLength)), nil
+}
+
+// ecdsaSignatureDER CKM_ECDSA'nın ham r||s çıktısını X.509'un beklediği
+// ASN.1 Ecdsa-Sig-Value yapısına çevirir
+func ecdsaSignatureDER(raw []byte) ([]byte, error) {
+	if len(raw) == 0 || len(raw)%2 != 0 {
+		return nil, fmt.Errorf("Hatalı ECDSA imzası: %d bayt", len(raw))
+	}
+	half := len(raw) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		new(big.Int).SetBytes(raw[:half]),
+		new(big.Int).SetBytes(raw[half:]),
+	})
+}
@@ -0,0 +1,131 @@
+package signature
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	pkcs11 "github.com/miekg/pkcs11"
+)
+
+func TestDigestInfo(t *testing.T) {
+	// DigestInfo önekleri RFC 8017, Bölüm 9.2, Not 1
+	tests := []struct {
+		hash    crypto.Hash
+		prefix  string
+		wantErr bool
+	}{
+		{crypto.SHA1, "3021300906052b0e03021a05000414", false},
+		{crypto.SHA256, "3031300d060960864801650304020105000420", false},
+		{crypto.SHA384, "3041300d060960864801650304020205000430", false},
+		{crypto.SHA512, "3051300d060960864801650304020305000440", false},
+		{crypto.Hash(0), "", false},
+		{crypto.MD5SHA1, "", false},
+		{crypto.BLAKE2b_256, "", true},
+	}
+	for _, tt := range tests {
+		size := 36
+		if tt.hash.Available() {
+			size = tt.hash.Size()
+		}
+		digest := bytes.Repeat([]byte{0xab}, size)
+		got, err := digestInfo(tt.hash, digest)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("digestInfo(%v) error = %v, wantErr %v", tt.hash, err, tt.wantErr)
+		}
+		if tt.wantErr {
+			continue
+		}
+		prefix, _ := hex.DecodeString(tt.prefix)
+		if want := append(prefix, digest...); !bytes.Equal(got, want) {
+			t.Errorf("digestInfo(%v) = %x, want %x", tt.hash, got, want)
+		}
+	}
+}
+
+func TestPSSParams(t *testing.T) {
+	pub := &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 2047), E: 65537}
+	tests := []struct {
+		name       string
+		hash       crypto.Hash
+		saltLength int
+		want       []byte
+		wantErr    bool
+	}{
+		{"auto", crypto.SHA256, rsa.PSSSaltLengthAuto, pkcs11.NewPSSParams(pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, 256-2-32), false},
+		{"equals hash", crypto.SHA512, rsa.PSSSaltLengthEqualsHash, pkcs11.NewPSSParams(pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512, 64), false},
+		{"explicit", crypto.SHA1, 20, pkcs11.NewPSSParams(pkcs11.CKM_SHA_1, pkcs11.CKG_MGF1_SHA1, 20), false},
+		{"unsupported hash", crypto.MD5, rsa.PSSSaltLengthAuto, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pssParams(pub, tt.hash, tt.saltLength)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("pssParams error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("pssParams = %x, want %x", got, tt.want)
+			}
+		})
+	}
+
+	// 512 bitlik anahtarda SHA-512 ile otomatik tuz uzunluğu negatif olur
+	small := &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 511), E: 65537}
+	if _, err := pssParams(small, crypto.SHA512, rsa.PSSSaltLengthAuto); err == nil {
+		t.Error("pssParams accepted a salt longer than the key allows")
+	}
+}
+
+func TestECDSASignatureDER(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("imzalanacak veri"))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+
+	der, err := ecdsaSignatureDER(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(&key.PublicKey, digest[:], der) {
+		t.Error("converted signature does not verify")
+	}
+
+	tests := []struct {
+		name string
+		raw  []byte
+		want string
+	}{
+		// Yüksek bitli değerler pozitif kalmak için 0x00 öneki alır, baştaki
+		// sıfırlar atılır
+		{"high bit", []byte{0x80, 0x01, 0x00, 0x7f}, "3008020300800102017f"},
+		{"leading zeros", []byte{0x00, 0x00, 0x00, 0x05}, "3006020100020105"},
+	}
+	for _, tt := range tests {
+		got, err := ecdsaSignatureDER(tt.raw)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("%s: ecdsaSignatureDER = %x, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	for _, raw := range [][]byte{nil, {0x01, 0x02, 0x03}} {
+		if _, err := ecdsaSignatureDER(raw); err == nil {
+			t.Errorf("ecdsaSignatureDER(%x) accepted a malformed signature", raw)
+		}
+	}
+}